@@ -0,0 +1,54 @@
+// Package annotation writes the aggregated labels of the voting database as COCO JSON and Pascal VOC XML annotations,
+// the formats read by most training pipelines.
+package annotation
+
+import (
+	"image"
+	"image/color"
+	// decoders for the picture formats whose dimensions can be read
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"os"
+	"path"
+)
+
+// Image is a picture to annotate. FileName is its path inside the dataset, Source is where it is read from,
+// and Label is the class it was voted into, or empty when it has none.
+type Image struct {
+	FileName string
+	Source   string
+	Width    int
+	Height   int
+	Depth    int
+	Label    string
+}
+
+// NewImage describes the picture at source, reading its dimensions from the file.
+func NewImage(source string, fileName string, label string) (Image, error) {
+	input, err := os.Open(source)
+	if err != nil {
+		return Image{}, err
+	}
+	defer input.Close()
+	config, _, err := image.DecodeConfig(input)
+	if err != nil {
+		return Image{}, err
+	}
+	return Image{
+		FileName: path.Clean(fileName),
+		Source:   source,
+		Width:    config.Width,
+		Height:   config.Height,
+		Depth:    depth(config),
+		Label:    label,
+	}, nil
+}
+
+// depth returns the amount of channels of a picture, 1 for grayscale ones and 3 for every other one.
+func depth(config image.Config) int {
+	if config.ColorModel == color.GrayModel || config.ColorModel == color.Gray16Model {
+		return 1
+	}
+	return 3
+}
@@ -0,0 +1,97 @@
+package annotation
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// fixtureImages reads the sample pictures of testdata.
+func fixtureImages(t *testing.T) []Image {
+	cat, err := NewImage(filepath.Join("testdata", "cat.png"), "train/cat/cat.png", "cat")
+	if err != nil {
+		t.Errorf("Unable to read cat.png: %s", err.Error())
+		t.FailNow()
+	}
+	dog, err := NewImage(filepath.Join("testdata", "dog.jpg"), "./train/undecided/dog.jpg", "")
+	if err != nil {
+		t.Errorf("Unable to read dog.jpg: %s", err.Error())
+		t.FailNow()
+	}
+	return []Image{cat, dog}
+}
+
+// compareFixture fails the test when content differs from the fixture file.
+func compareFixture(t *testing.T, name string, content []byte) {
+	path := filepath.Join("testdata", name)
+	if os.Getenv("UPDATE_FIXTURES") != "" {
+		ioutil.WriteFile(path, content, 0644)
+	}
+	expected, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Errorf("Unable to read fixture %s", name)
+		return
+	}
+	if !bytes.Equal(content, expected) {
+		t.Errorf("Unexpected %s:\n%s", name, content)
+	}
+}
+
+func TestNewImage(t *testing.T) {
+	images := fixtureImages(t)
+	if images[0].Width != 4 || images[0].Height != 3 || images[0].Depth != 3 {
+		t.Errorf("Unexpected dimensions for cat.png: %+v", images[0])
+	}
+	if images[1].Width != 5 || images[1].Height != 2 || images[1].Depth != 1 || images[1].FileName != "train/undecided/dog.jpg" {
+		t.Errorf("Unexpected dimensions for dog.jpg: %+v", images[1])
+	}
+	if _, err := NewImage(filepath.Join("testdata", "coco.json"), "coco.json", ""); err == nil {
+		t.Errorf("Expected files that are not pictures to be refused")
+	}
+}
+
+func TestCOCO(t *testing.T) {
+	dataset := NewCOCO(fixtureImages(t), []string{"cat", "dog"}, time.Date(2018, time.July, 20, 0, 0, 0, 0, time.UTC))
+	if len(dataset.Images) != 2 || len(dataset.Annotations) != 1 || len(dataset.Categories) != 2 {
+		t.Errorf("Expected two images and a single annotation, got %+v", dataset)
+	}
+	content, err := dataset.Encode()
+	if err != nil {
+		t.Errorf("Unable to encode COCO dataset")
+		t.FailNow()
+	}
+	compareFixture(t, "coco.json", content)
+	decoded, err := ReadCOCO(bytes.NewReader(content))
+	if err != nil || !reflect.DeepEqual(decoded, dataset) {
+		t.Errorf("COCO dataset changed after a round trip: %+v", decoded)
+	}
+}
+
+func TestVOC(t *testing.T) {
+	images := fixtureImages(t)
+	for index, name := range []string{"cat.xml", "dog.xml"} {
+		annotation := NewVOC(images[index])
+		content, err := annotation.Encode()
+		if err != nil {
+			t.Errorf("Unable to encode VOC annotation")
+			continue
+		}
+		compareFixture(t, name, content)
+		decoded, err := ReadVOC(bytes.NewReader(content))
+		if err != nil || !reflect.DeepEqual(decoded, annotation) {
+			t.Errorf("VOC annotation changed after a round trip: %+v", decoded)
+		}
+	}
+	if names := VOCNames(images[:1]); names[0] != "Annotations/train_cat_cat.png.xml" {
+		t.Errorf("Unexpected VOC annotation name %s", names[0])
+	}
+	names := VOCNames([]Image{{FileName: "cat.jpg"}, {FileName: "cat.png"}, {FileName: "a_b/c.jpg"}, {FileName: "a/b_c.jpg"}, {FileName: "a/b/c.jpg"}})
+	expected := []string{"Annotations/cat.jpg.xml", "Annotations/cat.png.xml", "Annotations/a_b_c.jpg.xml", "Annotations/a_b_c.jpg-2.xml", "Annotations/a_b_c.jpg-3.xml"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("Expected colliding pictures to get distinct annotation names, got %v", names)
+	}
+}
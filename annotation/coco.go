@@ -0,0 +1,104 @@
+package annotation
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+)
+
+// COCO is a dataset in the COCO annotation format. Every labeled image gets a single annotation whose
+// bounding box covers the whole picture, so the file is read both as classification and as detection data.
+type COCO struct {
+	Info        COCOInfo         `json:"info"`
+	Licenses    []COCOLicense    `json:"licenses"`
+	Images      []COCOImage      `json:"images"`
+	Annotations []COCOAnnotation `json:"annotations"`
+	Categories  []COCOCategory   `json:"categories"`
+}
+
+// COCOInfo describes a COCO dataset.
+type COCOInfo struct {
+	Description string `json:"description"`
+	Version     string `json:"version"`
+	Year        int    `json:"year"`
+	DateCreated string `json:"date_created"`
+}
+
+// COCOLicense is a license images of a COCO dataset can refer to.
+type COCOLicense struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+	URL  string `json:"url"`
+}
+
+// COCOImage is a picture of a COCO dataset.
+type COCOImage struct {
+	ID       int    `json:"id"`
+	FileName string `json:"file_name"`
+	Width    int    `json:"width"`
+	Height   int    `json:"height"`
+}
+
+// COCOAnnotation places an object of a category inside an image. BBox holds its x, y, width and height.
+type COCOAnnotation struct {
+	ID           int       `json:"id"`
+	ImageID      int       `json:"image_id"`
+	CategoryID   int       `json:"category_id"`
+	BBox         []float64 `json:"bbox"`
+	Area         float64   `json:"area"`
+	IsCrowd      int       `json:"iscrowd"`
+	Segmentation [][]int   `json:"segmentation"`
+}
+
+// COCOCategory is a class of a COCO dataset.
+type COCOCategory struct {
+	ID            int    `json:"id"`
+	Name          string `json:"name"`
+	Supercategory string `json:"supercategory"`
+}
+
+// NewCOCO creates the COCO dataset of images, numbering categories from 1 in the order they are given.
+// Images whose label is not one of the categories are listed without annotations.
+func NewCOCO(images []Image, categories []string, created time.Time) COCO {
+	dataset := COCO{
+		Info:        COCOInfo{Description: "colab-dataset export", Version: "1.0", Year: created.Year(), DateCreated: created.Format("2006/01/02")},
+		Licenses:    []COCOLicense{},
+		Images:      []COCOImage{},
+		Annotations: []COCOAnnotation{},
+		Categories:  []COCOCategory{},
+	}
+	ids := map[string]int{}
+	for index, name := range categories {
+		ids[name] = index + 1
+		dataset.Categories = append(dataset.Categories, COCOCategory{ID: index + 1, Name: name, Supercategory: "none"})
+	}
+	for index, item := range images {
+		image := COCOImage{ID: index + 1, FileName: item.FileName, Width: item.Width, Height: item.Height}
+		dataset.Images = append(dataset.Images, image)
+		category, ok := ids[item.Label]
+		if !ok {
+			continue
+		}
+		width, height := float64(item.Width), float64(item.Height)
+		dataset.Annotations = append(dataset.Annotations, COCOAnnotation{
+			ID:           len(dataset.Annotations) + 1,
+			ImageID:      image.ID,
+			CategoryID:   category,
+			BBox:         []float64{0, 0, width, height},
+			Area:         width * height,
+			Segmentation: [][]int{},
+		})
+	}
+	return dataset
+}
+
+// Encode returns the dataset as indented JSON.
+func (c COCO) Encode() ([]byte, error) {
+	return json.MarshalIndent(c, "", "  ")
+}
+
+// ReadCOCO decodes a COCO dataset.
+func ReadCOCO(r io.Reader) (dataset COCO, err error) {
+	err = json.NewDecoder(r).Decode(&dataset)
+	return
+}
@@ -0,0 +1,104 @@
+package annotation
+
+import (
+	"encoding/xml"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// VOC is the Pascal VOC annotation of a single image. Labeled images hold a single object whose bounding box covers the whole picture.
+type VOC struct {
+	XMLName   xml.Name    `xml:"annotation"`
+	Folder    string      `xml:"folder"`
+	Filename  string      `xml:"filename"`
+	Path      string      `xml:"path"`
+	Source    VOCSource   `xml:"source"`
+	Size      VOCSize     `xml:"size"`
+	Segmented int         `xml:"segmented"`
+	Objects   []VOCObject `xml:"object"`
+}
+
+// VOCSource names the database an annotation comes from.
+type VOCSource struct {
+	Database string `xml:"database"`
+}
+
+// VOCSize holds the dimensions of an image.
+type VOCSize struct {
+	Width  int `xml:"width"`
+	Height int `xml:"height"`
+	Depth  int `xml:"depth"`
+}
+
+// VOCObject is an object of a class inside an image.
+type VOCObject struct {
+	Name      string    `xml:"name"`
+	Pose      string    `xml:"pose"`
+	Truncated int       `xml:"truncated"`
+	Difficult int       `xml:"difficult"`
+	BndBox    VOCBndBox `xml:"bndbox"`
+}
+
+// VOCBndBox is the bounding box of an object, in pixels starting from 1 as the VOC tools expect.
+type VOCBndBox struct {
+	XMin int `xml:"xmin"`
+	YMin int `xml:"ymin"`
+	XMax int `xml:"xmax"`
+	YMax int `xml:"ymax"`
+}
+
+// NewVOC creates the VOC annotation of an image. Images without a label get no objects.
+func NewVOC(item Image) VOC {
+	annotation := VOC{
+		XMLName:  xml.Name{Local: "annotation"},
+		Folder:   path.Dir(item.FileName),
+		Filename: path.Base(item.FileName),
+		Path:     item.FileName,
+		Source:   VOCSource{Database: "colab-dataset"},
+		Size:     VOCSize{Width: item.Width, Height: item.Height, Depth: item.Depth},
+	}
+	if item.Label != "" {
+		annotation.Objects = append(annotation.Objects, VOCObject{
+			Name:   item.Label,
+			Pose:   "Unspecified",
+			BndBox: VOCBndBox{XMin: 1, YMin: 1, XMax: item.Width, YMax: item.Height},
+		})
+	}
+	return annotation
+}
+
+// Encode returns the annotation as an indented XML document.
+func (v VOC) Encode() ([]byte, error) {
+	content, err := xml.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(content, '\n'), nil
+}
+
+// VOCNames returns the names of the annotation files of images, in the same order, inside the Annotations folder of a VOC dataset.
+// Names keep the extension of the picture, so cat.jpg and cat.png are annotated apart, and nested pictures are flattened,
+// with their folders joined by underscores. Pictures whose flattened names still collide, such as a_b/c.jpg and a/b_c.jpg,
+// get a numbered suffix after the first one.
+func VOCNames(items []Image) []string {
+	names := make([]string, len(items))
+	taken := map[string]bool{}
+	for i, item := range items {
+		base := path.Join("Annotations", strings.Replace(item.FileName, "/", "_", -1))
+		name := base + ".xml"
+		for n := 2; taken[name]; n++ {
+			name = base + "-" + strconv.Itoa(n) + ".xml"
+		}
+		taken[name] = true
+		names[i] = name
+	}
+	return names
+}
+
+// ReadVOC decodes a VOC annotation.
+func ReadVOC(r io.Reader) (annotation VOC, err error) {
+	err = xml.NewDecoder(r).Decode(&annotation)
+	return
+}
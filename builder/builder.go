@@ -0,0 +1,294 @@
+// Package builder fills the voting database with the pictures found inside the static folder.
+// Files are walked in a fixed order, filtered, inspected by a bounded pool of workers, and inserted in walk order,
+// so the same folder always produces the same database.
+package builder
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"image"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/auyer/colab-dataset/db"
+	"github.com/auyer/colab-dataset/imagehash"
+)
+
+// Options decides which files are inserted, and how many are inspected at the same time.
+type Options struct {
+	// Workers is the amount of files inspected at the same time.
+	Workers int
+	// Include lists the glob patterns a file must match to be inserted, against its name or its path inside the folder. Empty accepts every file.
+	Include []string
+	// Exclude lists the glob patterns of the files never inserted, matched like Include.
+	Exclude []string
+	// Types lists the accepted MIME type prefixes, sniffed from the content of each file, such as "image/". Empty accepts every type.
+	Types []string
+	// Validate rejects pictures whose header can not be decoded.
+	Validate bool
+	// Progress, when not nil, is called after each file is handled with the amount of files handled so far and the total.
+	Progress func(done int, total int)
+}
+
+// File is a file accepted by Inspect, with the hashes of its content and its metadata.
+type File struct {
+	Path           string
+	Hash           string
+	PerceptualHash string
+	Metadata       db.Metadata
+}
+
+// Rejection is a file that was not inserted, and why.
+type Rejection struct {
+	Path   string `json:"Path"`
+	Reason string `json:"Reason"`
+}
+
+// Report describes the outcome of a build.
+// Errors lists the files that could not be read or inserted, which do not stop the build.
+type Report struct {
+	Files      int         `json:"Files"`
+	Inserted   int         `json:"Inserted"`
+	Existing   int         `json:"Existing"`
+	Duplicates int         `json:"Duplicates"`
+	Rejected   []Rejection `json:"Rejected"`
+	Errors     []string    `json:"Errors"`
+}
+
+// List returns the path of every file inside dir and its subfolders, sorted, and written as the keys of the database: dir, then "/" and the path inside it.
+func List(dir string) ([]string, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, info := range infos {
+		if info.IsDir() {
+			inner, err := List(dir + "/" + info.Name())
+			if err != nil {
+				return nil, err
+			}
+			paths = append(paths, inner...)
+		} else {
+			paths = append(paths, dir+"/"+info.Name())
+		}
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// Matches reports whether path, found inside dir, passes the Include and Exclude patterns.
+func (o Options) Matches(dir string, path string) bool {
+	name := filepath.Base(path)
+	relative := strings.TrimPrefix(strings.TrimPrefix(path, dir), "/")
+	match := func(patterns []string) bool {
+		for _, pattern := range patterns {
+			if ok, _ := filepath.Match(pattern, name); ok {
+				return true
+			}
+			if ok, _ := filepath.Match(pattern, relative); ok {
+				return true
+			}
+		}
+		return false
+	}
+	if len(o.Include) > 0 && !match(o.Include) {
+		return false
+	}
+	return !match(o.Exclude)
+}
+
+// Inspect reads the file at path once, sniffing its type, validating it and computing its hashes and metadata.
+// Files refused by the options get a rejection reason instead, and files that can not be read return an error.
+func Inspect(path string, options Options) (file File, reason string, err error) {
+	input, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer input.Close()
+	info, err := input.Stat()
+	if err != nil {
+		return
+	}
+	metadata := db.Metadata{Size: info.Size(), Modified: info.ModTime().UTC()}
+	header := make([]byte, 512)
+	n, err := io.ReadFull(input, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return
+	}
+	header = header[:n]
+	if n == 0 {
+		return file, "empty file", nil
+	}
+	kind := http.DetectContentType(header)
+	if !acceptedType(kind, options.Types) {
+		return file, "type " + kind + " is not accepted", nil
+	}
+	if strings.HasPrefix(kind, "image/") {
+		config, format, decodeErr := image.DecodeConfig(io.MultiReader(bytes.NewReader(header), input))
+		if options.Validate && decodeErr != nil && decodeErr != image.ErrFormat {
+			return file, "invalid picture: " + decodeErr.Error(), nil
+		}
+		if decodeErr == nil {
+			metadata.Width, metadata.Height, metadata.Format = config.Width, config.Height, format
+		}
+		_, err = input.Seek(int64(n), io.SeekStart)
+		if err != nil {
+			return
+		}
+	}
+	// the picture decoder may stop before the end of the file, so the rest of it is hashed afterwards
+	content := sha256.New()
+	content.Write(header)
+	dhash, decodeErr := imagehash.DHash(io.MultiReader(bytes.NewReader(header), io.TeeReader(input, content)))
+	_, err = io.Copy(content, input)
+	if err != nil {
+		return
+	}
+	if metadata.Format == "jpeg" {
+		_, err = input.Seek(0, io.SeekStart)
+		if err != nil {
+			return
+		}
+		fields, exifErr := readEXIF(input)
+		if exifErr == nil {
+			metadata.Taken, metadata.Camera, metadata.Orientation = fields.taken, fields.camera, fields.orientation
+		}
+	}
+	file = File{Path: path, Hash: hex.EncodeToString(content.Sum(nil)), Metadata: metadata}
+	if decodeErr == nil {
+		file.PerceptualHash = imagehash.Format(dhash)
+	}
+	return file, "", nil
+}
+
+// acceptedType reports whether the sniffed MIME type starts with one of the accepted prefixes.
+func acceptedType(kind string, types []string) bool {
+	if len(types) == 0 {
+		return true
+	}
+	for _, prefix := range types {
+		if strings.HasPrefix(kind, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// inspection is the outcome of inspecting a single file.
+type inspection struct {
+	file   File
+	reason string
+	err    error
+}
+
+// inspectAll inspects paths with a pool of options.Workers goroutines, calling handle with each outcome in the order of paths,
+// as soon as the outcomes before it are handled.
+func inspectAll(paths []string, options Options, handle func(i int, result inspection)) {
+	workers := options.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	results := make([]inspection, len(paths))
+	ready := make([]chan struct{}, len(paths))
+	for i := range ready {
+		ready[i] = make(chan struct{})
+	}
+	tasks := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range tasks {
+				file, reason, err := Inspect(paths[i], options)
+				results[i] = inspection{file: file, reason: reason, err: err}
+				close(ready[i])
+			}
+		}()
+	}
+	go func() {
+		for i := range paths {
+			tasks <- i
+		}
+		close(tasks)
+	}()
+	for i := range paths {
+		<-ready[i]
+		handle(i, results[i])
+		results[i] = inspection{}
+	}
+	wg.Wait()
+}
+
+// Build inserts every file inside dir that passes the options into the database. Files holding the same content as one
+// already inserted are recorded as its duplicates, and files already in the database get their hashes recorded.
+// Only failing to list dir stops the build; every other failure is listed in the report.
+func Build(dir string, store db.Store, options Options) (report Report, err error) {
+	paths, err := List(dir)
+	if err != nil {
+		return
+	}
+	report.Files = len(paths)
+	report.Rejected = []Rejection{}
+	report.Errors = []string{}
+	var accepted []string
+	for _, path := range paths {
+		if options.Matches(dir, path) {
+			accepted = append(accepted, path)
+		} else {
+			report.Rejected = append(report.Rejected, Rejection{Path: path, Reason: "excluded by pattern"})
+		}
+	}
+	// inspecting files is slow and runs in parallel, while inserting them runs in walk order so the canonical copy of duplicates is always the same
+	inspectAll(accepted, options, func(i int, result inspection) {
+		if result.err != nil {
+			report.Errors = append(report.Errors, accepted[i]+": "+result.err.Error())
+		} else if result.reason != "" {
+			report.Rejected = append(report.Rejected, Rejection{Path: accepted[i], Reason: result.reason})
+		} else {
+			insert(result.file, store, &report)
+		}
+		if options.Progress != nil {
+			options.Progress(i+1, len(accepted))
+		}
+	})
+	sort.Slice(report.Rejected, func(i, j int) bool { return report.Rejected[i].Path < report.Rejected[j].Path })
+	return report, nil
+}
+
+// insert adds an inspected file to the database, counting the outcome in report.
+// It returns the key the file is stored under, or false when the file is a duplicate or could not be inserted.
+func insert(file File, store db.Store, report *Report) (string, bool) {
+	canonical, err := store.InsertFile(file.Path, file.Hash)
+	switch err {
+	case nil:
+		report.Inserted++
+	case db.ErrKeyExists:
+		report.Existing++
+	case db.ErrDuplicateContent:
+		report.Duplicates++
+		return canonical, false
+	default:
+		report.Errors = append(report.Errors, file.Path+": "+err.Error())
+		return canonical, false
+	}
+	if file.PerceptualHash != "" {
+		err = store.SetPerceptualHash(canonical, file.PerceptualHash)
+		if err != nil {
+			report.Errors = append(report.Errors, file.Path+": "+err.Error())
+		}
+	}
+	err = store.SetMetadata(canonical, file.Metadata)
+	if err != nil {
+		report.Errors = append(report.Errors, file.Path+": "+err.Error())
+	}
+	return canonical, true
+}
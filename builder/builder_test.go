@@ -0,0 +1,352 @@
+package builder
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/auyer/colab-dataset/db"
+)
+
+const testDir = "./builder_test.go.tmp"
+
+// testOptions are the default ingest options of the configuration.
+var testOptions = Options{Workers: 4, Exclude: []string{".*", "Thumbs.db"}, Types: []string{"image/"}, Validate: true}
+
+// picture encodes a distinct PNG picture for seed.
+func picture(seed int) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, 16, 16))
+	for x := 0; x < 16; x++ {
+		for y := 0; y < 16; y++ {
+			img.Set(x, y, color.RGBA{uint8(x * seed), uint8(y * 16), uint8(seed), 255})
+		}
+	}
+	var buffer bytes.Buffer
+	png.Encode(&buffer, img)
+	return buffer.Bytes()
+}
+
+// exifPicture encodes a JPEG picture of 32x16 pixels holding the make, orientation and capture date EXIF fields.
+func exifPicture() []byte {
+	var tiff bytes.Buffer
+	entry := func(tag, kind uint16, count, value uint32) {
+		binary.Write(&tiff, binary.BigEndian, struct {
+			Tag, Kind    uint16
+			Count, Value uint32
+		}{tag, kind, count, value})
+	}
+	tiff.WriteString("MM\x00*")
+	binary.Write(&tiff, binary.BigEndian, uint32(8))
+	// IFD0 at 8 with 3 entries ends at 50, followed by the make, the Exif IFD at 56 and the date at 74
+	binary.Write(&tiff, binary.BigEndian, uint16(3))
+	entry(tagMake, 2, 6, 50)
+	entry(tagOrientation, 3, 1, 6<<16)
+	entry(tagExifIFD, 4, 1, 56)
+	binary.Write(&tiff, binary.BigEndian, uint32(0))
+	tiff.WriteString("Canon\x00")
+	binary.Write(&tiff, binary.BigEndian, uint16(1))
+	entry(tagDateTimeOriginal, 2, 20, 74)
+	binary.Write(&tiff, binary.BigEndian, uint32(0))
+	tiff.WriteString("2018:06:30 12:00:00\x00")
+
+	var encoded bytes.Buffer
+	jpeg.Encode(&encoded, image.NewGray(image.Rect(0, 0, 32, 16)), nil)
+	segment := append([]byte("Exif\x00\x00"), tiff.Bytes()...)
+	var buffer bytes.Buffer
+	buffer.Write([]byte{0xff, 0xd8, 0xff, 0xe1})
+	binary.Write(&buffer, binary.BigEndian, uint16(len(segment)+2))
+	buffer.Write(segment)
+	buffer.Write(encoded.Bytes()[2:])
+	return buffer.Bytes()
+}
+
+// writeTree creates the files of tree inside testDir.
+func writeTree(t *testing.T, tree map[string][]byte) {
+	for name, content := range tree {
+		path := filepath.Join(testDir, name)
+		os.MkdirAll(filepath.Dir(path), os.ModePerm)
+		err := ioutil.WriteFile(path, content, os.ModePerm)
+		if err != nil {
+			t.Errorf("Unable to create test file")
+			t.FailNow()
+		}
+	}
+}
+
+// initTest creates an empty test folder, and an empty storease kept in memory.
+func initTest(t *testing.T) db.Store {
+	os.RemoveAll(testDir)
+	return db.NewMemoryStore()
+}
+
+// closeTest closes the test storease and removes the test folder.
+func closeTest(store db.Store) {
+	store.Close()
+	os.RemoveAll(testDir)
+}
+
+func TestBuild(t *testing.T) {
+	store := initTest(t)
+	defer closeTest(store)
+	tree := map[string][]byte{
+		".DS_Store":          []byte("finder"),
+		"Thumbs.db":          []byte("explorer"),
+		"notes.txt":          []byte("not a picture"),
+		"empty.png":          {},
+		"broken/cut.png":     picture(99)[:20],
+		"a/copy.png":         picture(1),
+		"b/deep/copy.png":    picture(1),
+		"b/deep/.hidden.png": picture(2),
+	}
+	for i := 0; i < 50; i++ {
+		tree["pictures/"+strconv.Itoa(i/10)+"/"+strconv.Itoa(i)+".png"] = picture(i + 3)
+	}
+	writeTree(t, tree)
+	handled := 0
+	options := testOptions
+	options.Progress = func(done int, total int) {
+		handled = done
+	}
+	report, err := Build(testDir, store, options)
+	if err != nil {
+		t.Errorf("Unable to Build: %s", err.Error())
+		t.FailNow()
+	}
+	if report.Files != 58 || report.Inserted != 51 || report.Duplicates != 1 || len(report.Rejected) != 6 || len(report.Errors) != 0 {
+		t.Errorf("Unexpected build report: %+v", report)
+	}
+	if handled != 55 {
+		t.Errorf("Expected progress to reach every file passing the patterns, got %d", handled)
+	}
+	if store.CountDBSize() != 51 {
+		t.Errorf("Expected 51 keys, got %d", store.CountDBSize())
+	}
+	// duplicates are inserted in walk order, so the first path found is always the canonical one
+	resource, err := store.GetResource(testDir + "/a/copy.png")
+	if err != nil || len(resource.Duplicates) != 1 || resource.Duplicates[0] != testDir+"/b/deep/copy.png" || resource.PerceptualHash == "" {
+		t.Errorf("Unexpected canonical resource: %+v", resource)
+	}
+	for _, rejected := range []string{"/notes.txt", "/empty.png", "/broken/cut.png", "/.DS_Store"} {
+		if _, err := store.GetResource(testDir + rejected); err != db.ErrNotFound {
+			t.Errorf("Expected %s to be rejected", rejected)
+		}
+	}
+	report, _ = Build(testDir, store, testOptions)
+	if report.Inserted != 0 || report.Existing != 51 || store.CountDBSize() != 51 {
+		t.Errorf("Expected a second build to change nothing: %+v", report)
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	store := initTest(t)
+	defer closeTest(store)
+	writeTree(t, map[string][]byte{"camera.jpg": exifPicture(), "plain.png": picture(1)})
+	report, err := Build(testDir, store, testOptions)
+	if err != nil || report.Inserted != 2 {
+		t.Errorf("Unexpected build report: %+v", report)
+		t.FailNow()
+	}
+	resource, err := store.GetResource(testDir + "/camera.jpg")
+	if err != nil || resource.Metadata == nil {
+		t.Errorf("Expected metadata to be recorded: %+v", resource)
+		t.FailNow()
+	}
+	m := resource.Metadata
+	taken := time.Date(2018, 6, 30, 12, 0, 0, 0, time.UTC)
+	if m.Width != 32 || m.Height != 16 || m.Format != "jpeg" || m.Aspect() != 2 || m.Size != int64(len(exifPicture())) || m.Modified.IsZero() {
+		t.Errorf("Unexpected file metadata: %+v", m)
+	}
+	if m.Taken == nil || !m.Taken.Equal(taken) || m.Camera != "Canon" || m.Orientation != 6 {
+		t.Errorf("Unexpected EXIF metadata: %+v", m)
+	}
+	resource, _ = store.GetResource(testDir + "/plain.png")
+	if resource.Metadata == nil || resource.Metadata.Format != "png" || resource.Metadata.Width != 16 || resource.Metadata.Taken != nil {
+		t.Errorf("Unexpected metadata without EXIF: %+v", resource.Metadata)
+	}
+}
+
+func TestUpload(t *testing.T) {
+	store := initTest(t)
+	defer closeTest(store)
+	names := map[string]string{
+		"cat.png":                testDir + "/cats/cat.png",
+		"../../etc/passwd":       testDir + "/cats/passwd",
+		"C:\\Users\\me\\cat.png": testDir + "/cats/cat.png",
+		".hidden.png":            "",
+		"..":                     "",
+	}
+	for name, expected := range names {
+		target, err := UploadPath(testDir, "../cats/", name)
+		if target != expected || (expected == "") != (err == ErrInvalidPath) {
+			t.Errorf("Unexpected upload path for %s: %s %v", name, target, err)
+		}
+	}
+	if _, err := UploadPath(testDir, "cats/.git", "cat.png"); err != ErrInvalidPath {
+		t.Errorf("Expected hidden folders to be refused")
+	}
+	var report Report
+	target := testDir + "/cats/cat.png"
+	err := Upload(testDir, target, bytes.NewReader(picture(1)), 1<<20, store, testOptions, &report)
+	if err != nil || report.Inserted != 1 {
+		t.Errorf("Unable to Upload: %v %+v", err, report)
+		t.FailNow()
+	}
+	resource, err := store.GetResource(target)
+	if err != nil || resource.Hash == "" || resource.Metadata == nil || resource.Metadata.Width != 16 {
+		t.Errorf("Expected the upload to be inserted with its hashes and metadata: %+v", resource)
+	}
+	if info, err := os.Stat(target); err != nil || info.Mode().Perm() != 0644 {
+		t.Errorf("Expected the upload to be readable like the other pictures, got %v", info.Mode())
+	}
+	if err := Upload(testDir, target, bytes.NewReader(picture(2)), 1<<20, store, testOptions, &report); err != ErrFileExists {
+		t.Errorf("Expected existing files to be kept, got %v", err)
+	}
+	if err := Upload(testDir, testDir+"/large.png", bytes.NewReader(picture(3)), 10, store, testOptions, &report); err != ErrTooLarge {
+		t.Errorf("Expected large files to be refused, got %v", err)
+	}
+	Upload(testDir, testDir+"/notes/notes.png", bytes.NewReader([]byte("not a picture")), 1<<20, store, testOptions, &report)
+	Upload(testDir, testDir+"/large/large.png", bytes.NewReader(picture(3)), 10, store, testOptions, &report)
+	if _, err := os.Stat(testDir + "/large"); !os.IsNotExist(err) {
+		t.Errorf("Expected refused uploads not to create their folder")
+	}
+	if len(report.Rejected) != 1 || report.Rejected[0].Path != testDir+"/notes/notes.png" {
+		t.Errorf("Expected the text file to be rejected: %+v", report.Rejected)
+	}
+	paths, _ := List(testDir)
+	if len(paths) != 1 || paths[0] != target {
+		t.Errorf("Expected only the accepted upload to stay on disk, got %v", paths)
+	}
+	if _, err := os.Stat(testDir + "/notes"); !os.IsNotExist(err) {
+		t.Errorf("Expected rejected uploads not to create their folder")
+	}
+	if _, err := store.GetNewSortedKey("", "annotator"); err != nil {
+		t.Errorf("Expected the upload to be scheduled: %v", err)
+	}
+}
+
+func TestImport(t *testing.T) {
+	store := initTest(t)
+	defer closeTest(store)
+	writeTree(t, map[string][]byte{"a/1.png": picture(1), "a/2.png": picture(2), "b/3.png": picture(3), "unlisted.png": picture(4)})
+	labels := []string{"true", "false"}
+	writeTree(t, map[string][]byte{
+		"manifest.csv": []byte("path,priority,votes_true,votes_false,comment\na/1.png,1,2,,first\nbuilder_test.go.tmp/a/2.png,,,1,\n"),
+		"bad.jsonl":    []byte("{\"path\": \"b/3.png\"}\n\n{\"path\": \"../../main.go\"}\n{\"path\": \"missing.png\"}\n{\"path\": \"b/3.png\", \"labels\": {\"maybe\": 1}}\n"),
+	})
+	rows, err := ReadManifest(testDir + "/bad.jsonl")
+	if err != nil || len(rows) != 4 || rows[1].Line != 3 {
+		t.Errorf("Unable to read the JSONL manifest: %v %+v", err, rows)
+		t.FailNow()
+	}
+	report, err := Import(testDir, rows, labels, store, testOptions)
+	if err != ErrInvalidManifest || len(report.Rejected) != 3 || store.CountDBSize() != 0 {
+		t.Errorf("Expected the invalid manifest to be refused without inserting anything: %v %+v", err, report)
+	}
+	rows, err = ReadManifest(testDir + "/manifest.csv")
+	if err != nil || len(rows) != 2 {
+		t.Errorf("Unable to read the CSV manifest: %v %+v", err, rows)
+		t.FailNow()
+	}
+	report, err = Import(testDir, rows, labels, store, testOptions)
+	if err != nil || report.Inserted != 2 || store.CountDBSize() != 2 {
+		t.Errorf("Unexpected import report: %v %+v", err, report)
+	}
+	resource, _ := store.GetResource(testDir + "/a/1.png")
+	if resource.Vote != 2 || resource.TotalVotes != 2 || resource.Priority != 1 || resource.Metadata == nil {
+		t.Errorf("Unexpected imported resource: %+v", resource)
+	}
+	resource, _ = store.GetResource(testDir + "/a/2.png")
+	if resource.Vote != -1 || resource.Labels["false"] != 1 {
+		t.Errorf("Expected paths starting with the static folder to be imported: %+v", resource)
+	}
+	report, _ = Import(testDir, rows, labels, store, testOptions)
+	resource, _ = store.GetResource(testDir + "/a/1.png")
+	if report.Existing != 2 || resource.TotalVotes != 2 {
+		t.Errorf("Expected a second import to keep the same prior: %+v %+v", report, resource)
+	}
+}
+
+func TestMatches(t *testing.T) {
+	options := Options{Include: []string{"*.jpg", "raw/*"}, Exclude: []string{".*"}}
+	cases := map[string]bool{
+		"./static/a/cat.jpg":  true,
+		"./static/raw/cat":    true,
+		"./static/a/cat.png":  false,
+		"./static/a/.cat.jpg": false,
+	}
+	for path, expected := range cases {
+		if options.Matches("./static", path) != expected {
+			t.Errorf("Expected %s to match %v", path, expected)
+		}
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	store := initTest(t)
+	defer closeTest(store)
+	writeTree(t, map[string][]byte{"kept.png": picture(1), "moved.png": picture(2), "removed.png": picture(3)})
+	Build(testDir, store, testOptions)
+	store.CastVote(db.VoteRecord{Annotator: "alice", Key: testDir + "/moved.png", Label: "true", Score: 1})
+	os.MkdirAll(filepath.Join(testDir, "inner"), os.ModePerm)
+	os.Rename(filepath.Join(testDir, "moved.png"), filepath.Join(testDir, "inner", "moved.png"))
+	os.Remove(filepath.Join(testDir, "removed.png"))
+	writeTree(t, map[string][]byte{"new.png": picture(4), "notes.txt": []byte("text")})
+	report, err := Reconcile(testDir, store, testOptions)
+	if err != nil {
+		t.Errorf("Unable to Reconcile: %s", err.Error())
+		t.FailNow()
+	}
+	if report.Added != 1 || report.Moved[testDir+"/moved.png"] != testDir+"/inner/moved.png" || len(report.Missing) != 1 || len(report.Rejected) != 1 {
+		t.Errorf("Unexpected reconcile report: %+v", report)
+	}
+	resource, _ := store.GetResource(testDir + "/inner/moved.png")
+	if resource.Vote != 1 {
+		t.Errorf("Expected the moved file to keep its votes")
+	}
+	resource, _ = store.GetResource(testDir + "/removed.png")
+	if !resource.Orphaned {
+		t.Errorf("Expected the removed file to be orphaned")
+	}
+	writeTree(t, map[string][]byte{"removed.png": picture(3)})
+	report, _ = Reconcile(testDir, store, testOptions)
+	if report.Restored != 1 || report.Added != 0 || report.Changed != 0 {
+		t.Errorf("Expected the removed file to be restored: %+v", report)
+	}
+}
+
+func TestReconcileChanged(t *testing.T) {
+	store := initTest(t)
+	defer closeTest(store)
+	writeTree(t, map[string][]byte{"cat.png": picture(1), "copy.png": picture(1)})
+	Build(testDir, store, testOptions)
+	store.CastVote(db.VoteRecord{Annotator: "alice", Key: testDir + "/cat.png", Label: "true", Score: 1})
+	before, _ := store.GetResource(testDir + "/cat.png")
+	writeTree(t, map[string][]byte{"cat.png": picture(5)})
+	// the new content may be written within the same second, so its modification time is moved explicitly
+	os.Chtimes(testDir+"/cat.png", time.Now(), before.Metadata.Modified.Add(time.Minute))
+	report, err := Reconcile(testDir, store, testOptions)
+	if err != nil || report.Changed != 1 || report.Added != 1 {
+		t.Errorf("Expected the replaced file to be inspected again: %+v %v", report, err)
+	}
+	resource, _ := store.GetResource(testDir + "/cat.png")
+	if resource.Hash == before.Hash || len(resource.Duplicates) != 0 || resource.Vote != 1 || !resource.Metadata.Modified.After(before.Metadata.Modified) {
+		t.Errorf("Expected the replaced file to get its new hashes and keep its votes: %+v", resource)
+	}
+	copied, err := store.GetResource(testDir + "/copy.png")
+	if err != nil || copied.Hash != before.Hash {
+		t.Errorf("Expected the former duplicate to be inserted on its own: %+v %v", copied, err)
+	}
+	report, _ = Reconcile(testDir, store, testOptions)
+	if report.Changed != 0 || report.Added != 0 {
+		t.Errorf("Expected unchanged files not to be inspected again: %+v", report)
+	}
+}
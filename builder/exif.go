@@ -0,0 +1,131 @@
+package builder
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+	"time"
+)
+
+// EXIF tags read by readEXIF.
+const (
+	tagMake             = 0x010f
+	tagModel            = 0x0110
+	tagOrientation      = 0x0112
+	tagDateTime         = 0x0132
+	tagExifIFD          = 0x8769
+	tagDateTimeOriginal = 0x9003
+)
+
+// exifTimeLayout is the layout of EXIF dates, which hold no time zone.
+const exifTimeLayout = "2006:01:02 15:04:05"
+
+// errNoEXIF is returned by readEXIF for pictures without EXIF fields.
+var errNoEXIF = errors.New("No EXIF fields")
+
+// exifFields are the EXIF fields stored in the metadata of pictures.
+type exifFields struct {
+	taken       *time.Time
+	camera      string
+	orientation int
+}
+
+// readEXIF reads the EXIF fields of the JPEG picture read from r, walking its segments up to the image data.
+func readEXIF(r io.Reader) (fields exifFields, err error) {
+	reader := bufio.NewReader(r)
+	marker := make([]byte, 2)
+	_, err = io.ReadFull(reader, marker)
+	if err != nil || marker[0] != 0xff || marker[1] != 0xd8 {
+		return fields, errNoEXIF
+	}
+	for {
+		_, err = io.ReadFull(reader, marker)
+		if err != nil || marker[0] != 0xff {
+			return fields, errNoEXIF
+		}
+		// start of scan, the image data follows and no more metadata can be found
+		if marker[1] == 0xda {
+			return fields, errNoEXIF
+		}
+		var length uint16
+		err = binary.Read(reader, binary.BigEndian, &length)
+		if err != nil || length < 2 {
+			return fields, errNoEXIF
+		}
+		segment := make([]byte, length-2)
+		_, err = io.ReadFull(reader, segment)
+		if err != nil {
+			return fields, errNoEXIF
+		}
+		if marker[1] == 0xe1 && strings.HasPrefix(string(segment), "Exif\x00\x00") {
+			return parseTIFF(segment[6:])
+		}
+	}
+}
+
+// parseTIFF reads the EXIF fields of a TIFF structure, as found inside the APP1 segment of JPEG pictures.
+func parseTIFF(data []byte) (fields exifFields, err error) {
+	if len(data) < 8 {
+		return fields, errNoEXIF
+	}
+	var order binary.ByteOrder
+	switch string(data[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return fields, errNoEXIF
+	}
+	values := map[uint16][]byte{}
+	offset := order.Uint32(data[4:8])
+	readIFD(data, order, offset, values)
+	if pointer, ok := values[tagExifIFD]; ok && len(pointer) >= 4 {
+		readIFD(data, order, order.Uint32(pointer), values)
+	}
+	date := values[tagDateTimeOriginal]
+	if date == nil {
+		date = values[tagDateTime]
+	}
+	if date != nil {
+		taken, err := time.Parse(exifTimeLayout, strings.TrimRight(string(date), "\x00 "))
+		if err == nil {
+			fields.taken = &taken
+		}
+	}
+	camera := strings.TrimSpace(strings.TrimRight(string(values[tagMake]), "\x00") + " " + strings.TrimRight(string(values[tagModel]), "\x00"))
+	fields.camera = camera
+	if orientation := values[tagOrientation]; len(orientation) >= 2 {
+		fields.orientation = int(order.Uint16(orientation))
+	}
+	return fields, nil
+}
+
+// readIFD stores the raw value of every entry of the image file directory at offset inside values.
+// Values longer than 4 bytes are read from the offset they point to. Malformed entries are skipped.
+func readIFD(data []byte, order binary.ByteOrder, offset uint32, values map[uint16][]byte) {
+	if int64(offset)+2 > int64(len(data)) {
+		return
+	}
+	count := int(order.Uint16(data[offset:]))
+	sizes := map[uint16]uint32{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 7: 1, 9: 4, 10: 8}
+	for i := 0; i < count; i++ {
+		start := int64(offset) + 2 + int64(i)*12
+		if start+12 > int64(len(data)) {
+			return
+		}
+		entry := data[start : start+12]
+		tag := order.Uint16(entry[0:2])
+		size := int64(sizes[order.Uint16(entry[2:4])]) * int64(order.Uint32(entry[4:8]))
+		if size <= 4 {
+			values[tag] = entry[8 : 8+size]
+			continue
+		}
+		pointer := int64(order.Uint32(entry[8:12]))
+		if pointer+size <= int64(len(data)) {
+			values[tag] = data[pointer : pointer+size]
+		}
+	}
+}
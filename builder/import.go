@@ -0,0 +1,198 @@
+package builder
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/auyer/colab-dataset/db"
+)
+
+// ErrInvalidManifest is returned by Import when some rows of the manifest can not be imported. Nothing is inserted in that case.
+var ErrInvalidManifest = errors.New("Invalid manifest")
+
+// ImportRow is a line of an import manifest: the path of a file inside the static folder, the prior label counts to seed it with,
+// and its scheduling priority. Line is the line of the manifest it was read from.
+type ImportRow struct {
+	Path     string         `json:"path"`
+	Labels   map[string]int `json:"labels"`
+	Priority int            `json:"priority"`
+	Line     int            `json:"-"`
+}
+
+// ReadManifest reads the rows of the import manifest at path, a CSV file when its name ends with .csv, and a JSONL file otherwise.
+//
+// JSONL lines hold a path, and optionally labels with a count per label and a priority, so a label file written by
+// /api/results/?format=jsonl can be imported again. CSV files start with a header naming a path column, and optionally
+// a priority column and votes_<label> columns holding the count of each label. Other fields and columns are ignored.
+func ReadManifest(path string) ([]ImportRow, error) {
+	input, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer input.Close()
+	if strings.HasSuffix(strings.ToLower(path), ".csv") {
+		return readCSVManifest(input)
+	}
+	return readJSONLManifest(input)
+}
+
+// readJSONLManifest reads a manifest holding a JSON object per line. Blank lines are skipped.
+func readJSONLManifest(r io.Reader) ([]ImportRow, error) {
+	var rows []ImportRow
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		row := ImportRow{Line: line}
+		err := json.Unmarshal(scanner.Bytes(), &row)
+		if err != nil {
+			return nil, errors.New("line " + strconv.Itoa(line) + ": " + err.Error())
+		}
+		rows = append(rows, row)
+	}
+	return rows, scanner.Err()
+}
+
+// readCSVManifest reads a manifest holding a header and a record per line.
+func readCSVManifest(r io.Reader) ([]ImportRow, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err != nil {
+		return nil, err
+	}
+	columns := map[string]int{}
+	for i, name := range header {
+		columns[strings.TrimSpace(name)] = i
+	}
+	pathColumn, ok := columns["path"]
+	if !ok {
+		return nil, errors.New("the manifest header has no path column")
+	}
+	var rows []ImportRow
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return rows, nil
+		} else if err != nil {
+			return nil, err
+		}
+		field := func(column int) string {
+			if column < len(record) {
+				return strings.TrimSpace(record[column])
+			}
+			return ""
+		}
+		row := ImportRow{Path: field(pathColumn), Labels: map[string]int{}, Line: line}
+		for name, column := range columns {
+			value := field(column)
+			if value == "" || (name != "priority" && !strings.HasPrefix(name, "votes_")) {
+				continue
+			}
+			number, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, errors.New("line " + strconv.Itoa(line) + ": invalid " + name + " " + value)
+			}
+			if name == "priority" {
+				row.Priority = number
+			} else {
+				row.Labels[strings.TrimPrefix(name, "votes_")] = number
+			}
+		}
+		rows = append(rows, row)
+	}
+}
+
+// importPath returns the key of the file a manifest row points to inside dir. Paths are relative to dir,
+// or start with dir itself like the paths of label files, and can not climb out of it.
+func importPath(dir string, rowPath string) (string, error) {
+	clean := path.Clean(strings.Replace(rowPath, "\\", "/", -1))
+	root := path.Clean(filepath.ToSlash(dir))
+	if strings.HasPrefix(clean, root+"/") {
+		clean = strings.TrimPrefix(clean, root+"/")
+	}
+	if rowPath == "" || clean == "." || path.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", ErrInvalidPath
+	}
+	return dir + "/" + clean, nil
+}
+
+// Import inserts the files listed by a manifest, which must all exist inside dir, seeding their prior label counts and priority.
+// labels is the label schema: counts on other labels are refused, and the first one counts as positive.
+// Every row is checked before anything is inserted, and when some are invalid they are listed in the report with ErrInvalidManifest.
+// Otherwise the files are inspected and inserted like Build, and files already in the database get their prior and priority replaced.
+// The Include and Exclude patterns of the options are not applied, since every file is listed on purpose.
+func Import(dir string, rows []ImportRow, labels []string, store db.Store, options Options) (report Report, err error) {
+	report.Files = len(rows)
+	report.Rejected = []Rejection{}
+	report.Errors = []string{}
+	known := map[string]bool{}
+	for _, label := range labels {
+		known[label] = true
+	}
+	paths := make([]string, len(rows))
+	seen := map[string]int{}
+	for i, row := range rows {
+		reject := func(reason string) {
+			report.Rejected = append(report.Rejected, Rejection{Path: row.Path, Reason: "line " + strconv.Itoa(row.Line) + ": " + reason})
+		}
+		var pathErr error
+		paths[i], pathErr = importPath(dir, row.Path)
+		if pathErr != nil {
+			reject("the path is outside of the static folder")
+			continue
+		}
+		if line, ok := seen[paths[i]]; ok {
+			reject("already listed on line " + strconv.Itoa(line))
+			continue
+		}
+		seen[paths[i]] = row.Line
+		info, statErr := os.Stat(paths[i])
+		if statErr != nil || info.IsDir() {
+			reject("no such file")
+			continue
+		}
+		for label, count := range row.Labels {
+			if !known[label] {
+				reject("unknown label " + label)
+			} else if count < 0 {
+				reject("negative count for label " + label)
+			}
+		}
+	}
+	if len(report.Rejected) > 0 {
+		return report, ErrInvalidManifest
+	}
+	positive := ""
+	if len(labels) > 0 {
+		positive = labels[0]
+	}
+	inspectAll(paths, options, func(i int, result inspection) {
+		if result.err != nil {
+			report.Errors = append(report.Errors, paths[i]+": "+result.err.Error())
+		} else if result.reason != "" {
+			report.Rejected = append(report.Rejected, Rejection{Path: paths[i], Reason: result.reason})
+		} else if key, ok := insert(result.file, store, &report); ok {
+			err := store.SetPrior(key, rows[i].Labels, positive, rows[i].Priority)
+			if err != nil {
+				report.Errors = append(report.Errors, paths[i]+": "+err.Error())
+			}
+		}
+		if options.Progress != nil {
+			options.Progress(i+1, len(paths))
+		}
+	})
+	sort.Slice(report.Rejected, func(i, j int) bool { return report.Rejected[i].Path < report.Rejected[j].Path })
+	return report, nil
+}
@@ -0,0 +1,196 @@
+package builder
+
+import (
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/auyer/colab-dataset/db"
+)
+
+// ReconcileReport describes the changes made by Reconcile. Moved maps the old path of every moved file to its new one.
+type ReconcileReport struct {
+	Added      int               `json:"Added"`
+	Changed    int               `json:"Changed"`
+	Duplicates int               `json:"Duplicates"`
+	Restored   int               `json:"Restored"`
+	Pruned     int               `json:"Pruned"`
+	Moved      map[string]string `json:"Moved"`
+	Missing    []string          `json:"Missing"`
+	Rejected   []Rejection       `json:"Rejected"`
+	Errors     []string          `json:"Errors"`
+}
+
+// String summarizes the changes.
+func (r ReconcileReport) String() string {
+	return fmt.Sprintf("%d added, %d changed, %d duplicates of known files, %d moved, %d missing, %d back in place, %d duplicates removed, %d rejected, %d errors",
+		r.Added, r.Changed, r.Duplicates, len(r.Moved), len(r.Missing), r.Restored, r.Pruned, len(r.Rejected), len(r.Errors))
+}
+
+// Reconcile updates the database with the changes made to dir since it was built.
+// New files passing the options are inserted, missing ones are marked as orphaned keeping their votes, and files moved
+// to another path, found by their content hash, take their votes with them. Orphaned files that came back are scheduled again.
+// Files whose size or modification time differ from their stored metadata are inspected again, keeping their votes,
+// and the paths that held the same content as them before are inserted on their own.
+func Reconcile(dir string, store db.Store, options Options) (report ReconcileReport, err error) {
+	paths, err := List(dir)
+	if err != nil {
+		return
+	}
+	report.Moved = map[string]string{}
+	report.Missing = []string{}
+	report.Rejected = []Rejection{}
+	report.Errors = []string{}
+	onDisk := map[string]bool{}
+	for _, path := range paths {
+		onDisk[path] = true
+	}
+	resources, err := store.GetCurrentVotes()
+	if err != nil {
+		return
+	}
+	known := map[string]bool{}
+	for _, resource := range resources {
+		known[resource.Key] = true
+		for _, duplicate := range resource.Duplicates {
+			known[duplicate] = true
+		}
+	}
+	// only the new and changed files are inspected, the hashes of the other known ones are still valid
+	var pending []string
+	for _, path := range paths {
+		if known[path] {
+			continue
+		} else if !options.Matches(dir, path) {
+			report.Rejected = append(report.Rejected, Rejection{Path: path, Reason: "excluded by pattern"})
+		} else {
+			pending = append(pending, path)
+		}
+	}
+	changed := map[string]string{}
+	for _, resource := range resources {
+		if onDisk[resource.Key] && resource.Metadata != nil && modified(resource.Key, *resource.Metadata) {
+			changed[resource.Key] = resource.Hash
+			pending = append(pending, resource.Key)
+		}
+	}
+	var added, replaced []File
+	inspected := map[string]File{}
+	moved := map[string][]string{}
+	inspectAll(pending, options, func(i int, result inspection) {
+		if result.err != nil {
+			report.Errors = append(report.Errors, pending[i]+": "+result.err.Error())
+		} else if result.reason != "" {
+			report.Rejected = append(report.Rejected, Rejection{Path: pending[i], Reason: result.reason})
+		} else if _, ok := changed[pending[i]]; ok {
+			replaced = append(replaced, result.file)
+		} else {
+			added = append(added, result.file)
+			inspected[result.file.Path] = result.file
+			moved[result.file.Hash] = append(moved[result.file.Hash], result.file.Path)
+		}
+	})
+	renamed := map[string]bool{}
+	for _, resource := range resources {
+		var duplicates []string
+		for _, duplicate := range resource.Duplicates {
+			if onDisk[duplicate] {
+				duplicates = append(duplicates, duplicate)
+			} else if store.RemoveDuplicate(resource.Key, duplicate) == nil {
+				report.Pruned++
+			}
+		}
+		if onDisk[resource.Key] {
+			if resource.Orphaned && store.SetOrphaned(resource.Key, false) == nil {
+				report.Restored++
+			}
+			continue
+		}
+		// a missing file is looked for among the new files with the same content, and then among its own duplicates
+		target := ""
+		if resource.Hash != "" && len(moved[resource.Hash]) > 0 {
+			target = moved[resource.Hash][0]
+			moved[resource.Hash] = moved[resource.Hash][1:]
+		} else if len(duplicates) > 0 {
+			target = duplicates[0]
+		}
+		if target != "" {
+			err = store.RenameResource(resource.Key, target)
+			if err != nil {
+				report.Errors = append(report.Errors, resource.Key+": "+err.Error())
+				continue
+			}
+			renamed[target] = true
+			report.Moved[resource.Key] = target
+			// the moved file may have been touched, so its metadata is read again
+			if file, ok := inspected[target]; ok {
+				err = store.SetMetadata(target, file.Metadata)
+				if err != nil {
+					report.Errors = append(report.Errors, target+": "+err.Error())
+				}
+			}
+		} else if !resource.Orphaned {
+			err = store.SetOrphaned(resource.Key, true)
+			if err != nil {
+				report.Errors = append(report.Errors, resource.Key+": "+err.Error())
+				continue
+			}
+			report.Missing = append(report.Missing, resource.Key)
+		}
+	}
+	// replaced files keep their votes, and their former duplicates no longer hold the same content
+	var released []string
+	for _, file := range replaced {
+		// files only touched, keeping the same content, just get their metadata updated
+		if file.Hash == changed[file.Path] {
+			err = store.SetMetadata(file.Path, file.Metadata)
+			if err != nil {
+				report.Errors = append(report.Errors, file.Path+": "+err.Error())
+			}
+			continue
+		}
+		duplicates, err := store.ReplaceContent(file.Path, file.Hash)
+		if err == nil {
+			err = store.SetPerceptualHash(file.Path, file.PerceptualHash)
+		}
+		if err == nil {
+			err = store.SetMetadata(file.Path, file.Metadata)
+		}
+		if err != nil {
+			report.Errors = append(report.Errors, file.Path+": "+err.Error())
+			continue
+		}
+		report.Changed++
+		for _, duplicate := range duplicates {
+			if onDisk[duplicate] {
+				released = append(released, duplicate)
+			}
+		}
+	}
+	inspectAll(released, options, func(i int, result inspection) {
+		if result.err != nil {
+			report.Errors = append(report.Errors, released[i]+": "+result.err.Error())
+		} else if result.reason != "" {
+			report.Rejected = append(report.Rejected, Rejection{Path: released[i], Reason: result.reason})
+		} else {
+			added = append(added, result.file)
+		}
+	})
+	var build Report
+	for _, file := range added {
+		if !renamed[file.Path] {
+			insert(file, store, &build)
+		}
+	}
+	report.Added = build.Inserted
+	report.Duplicates = build.Duplicates
+	report.Errors = append(report.Errors, build.Errors...)
+	sort.Slice(report.Rejected, func(i, j int) bool { return report.Rejected[i].Path < report.Rejected[j].Path })
+	return report, nil
+}
+
+// modified reports whether the file at path no longer has the size and modification time recorded in its metadata.
+func modified(path string, metadata db.Metadata) bool {
+	info, err := os.Stat(path)
+	return err == nil && (info.Size() != metadata.Size || !info.ModTime().UTC().Equal(metadata.Modified))
+}
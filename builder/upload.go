@@ -0,0 +1,100 @@
+package builder
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/auyer/colab-dataset/db"
+)
+
+var (
+	// ErrInvalidPath is returned by Upload for file names that are empty, hidden, or not a single file name.
+	ErrInvalidPath = errors.New("Invalid file name")
+	// ErrFileExists is returned by Upload when a file is already stored at the requested path.
+	ErrFileExists = errors.New("A file already exists at this path")
+	// ErrTooLarge is returned by Upload for files larger than the size limit.
+	ErrTooLarge = errors.New("File is larger than the upload limit")
+)
+
+// UploadPath returns the path, written as a key of the database, where a file named name is stored inside folder, a subfolder of dir.
+// Only the last element of name is kept, and folder can not climb out of dir.
+func UploadPath(dir string, folder string, name string) (string, error) {
+	name = path.Base(strings.Replace(name, "\\", "/", -1))
+	if name == "." || name == "/" || strings.HasPrefix(name, ".") || strings.ContainsRune(name, 0) {
+		return "", ErrInvalidPath
+	}
+	folder = path.Clean("/" + strings.Replace(folder, "\\", "/", -1))
+	for _, element := range strings.Split(folder, "/") {
+		if strings.HasPrefix(element, ".") || strings.ContainsRune(element, 0) {
+			return "", ErrInvalidPath
+		}
+	}
+	return strings.TrimSuffix(dir+folder, "/") + "/" + name, nil
+}
+
+// Upload stores at most maxSize bytes read from r at target, a path returned by UploadPath, then inspects and inserts it like Build,
+// counting the outcome in report. Files refused by the options are removed and listed as rejected.
+// It fails with ErrFileExists, ErrTooLarge, or the error met while writing the file.
+//
+// The content is first written to a hidden file inside dir, so a partial upload is never seen by the watcher,
+// and the folders of target are only created once the file is accepted.
+func Upload(dir string, target string, r io.Reader, maxSize int64, store db.Store, options Options, report *Report) error {
+	if !options.Matches(dir, target) {
+		report.Rejected = append(report.Rejected, Rejection{Path: target, Reason: "excluded by pattern"})
+		return nil
+	}
+	if _, err := os.Stat(target); err == nil {
+		return ErrFileExists
+	}
+	// the content is kept in dir until it is accepted, so refused uploads never leave folders behind
+	err := os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		return err
+	}
+	temporary, err := ioutil.TempFile(dir, ".upload-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temporary.Name())
+	written, err := io.Copy(temporary, io.LimitReader(r, maxSize+1))
+	closeErr := temporary.Close()
+	if err != nil {
+		return err
+	} else if closeErr != nil {
+		return closeErr
+	}
+	if written > maxSize {
+		return ErrTooLarge
+	}
+	file, reason, err := Inspect(temporary.Name(), options)
+	if err != nil {
+		return err
+	} else if reason != "" {
+		report.Rejected = append(report.Rejected, Rejection{Path: target, Reason: reason})
+		return nil
+	}
+	err = os.MkdirAll(filepath.Dir(target), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	// temporary files are only readable by their owner, unlike the rest of the static folder
+	err = os.Chmod(temporary.Name(), 0644)
+	if err != nil {
+		return err
+	}
+	// linking fails when target was created in the meantime, where renaming would replace it
+	err = os.Link(temporary.Name(), target)
+	if os.IsExist(err) {
+		return ErrFileExists
+	} else if err != nil {
+		return err
+	}
+	file.Path = target
+	insert(file, store, report)
+	return nil
+}
@@ -3,6 +3,7 @@ package config
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -26,8 +27,24 @@ var (
 		TLSKeyLocation:  "./devssl/server.key",
 		TLSCertLocation: "./devssl/server.pem",
 		DatabasePath:    "./votes.db",
+		Storage:         "badger",
 		Debug:           "true",
 		StaticFolder:    "/static",
+		Labels:          []string{"true", "false"},
+		LeaseTTL:        300,
+		ExportWorkers:   4,
+		ExportMode:      "copy",
+		WatchDebounce:   2000,
+		Ingest: ingestStruct{
+			Workers:  4,
+			Exclude:  []string{".*", "Thumbs.db", "desktop.ini"},
+			Types:    []string{"image/", "video/"},
+			Validate: true,
+		},
+		Upload: uploadStruct{
+			MaxSize:        32 << 20,
+			MaxRequestSize: 256 << 20,
+		},
 	}
 )
 
@@ -43,6 +60,57 @@ type configStruct struct {
 	DatabasePath    string `json:"DatabasePath"`
 	Debug           string `json:"Debug"`
 	StaticFolder    string `json:"StaticFolder"`
+	// Storage is the engine keeping the database at DatabasePath: "badger", a folder, or "bolt", a single file.
+	Storage string `json:"Storage"`
+	// Labels lists the distinct classes voters can choose from. The first label is treated as the positive one when computing scores.
+	Labels []string `json:"Labels"`
+	// LeaseTTL is the amount of seconds a picture handed to an annotator stays reserved for them. It must be positive.
+	LeaseTTL int `json:"LeaseTTL"`
+	// Completion decides when a picture received enough votes to stop being served.
+	Completion completionStruct `json:"Completion"`
+	// ExportWorkers is the amount of files each export copies at the same time.
+	ExportWorkers int `json:"ExportWorkers"`
+	// ExportMode decides whether exports copy, hardlink or symlink the pictures, unless a request asks for another mode.
+	ExportMode string `json:"ExportMode"`
+	// Watch inserts the files added to the static folder while the server runs, and marks the removed ones as orphaned.
+	Watch bool `json:"Watch"`
+	// WatchDebounce is the amount of milliseconds without changes the watcher waits for before updating the database.
+	WatchDebounce int `json:"WatchDebounce"`
+	// Ingest decides which files of the static folder are inserted in the database.
+	Ingest ingestStruct `json:"Ingest"`
+	// Upload decides who can add pictures through the API, and how large they can be.
+	Upload uploadStruct `json:"Upload"`
+}
+
+// completionStruct is the consensus policy expected in the configuration file. Zero values disable each rule.
+type completionStruct struct {
+	MinVotes  int     `json:"MinVotes"`
+	Agreement float64 `json:"Agreement"`
+	MaxVotes  int     `json:"MaxVotes"`
+	MaxSkips  int     `json:"MaxSkips"`
+}
+
+// ingestStruct is the file filtering expected in the configuration file.
+// Include and Exclude hold glob patterns, and Types holds MIME type prefixes sniffed from the content of each file.
+type ingestStruct struct {
+	Workers  int      `json:"Workers"`
+	Include  []string `json:"Include"`
+	Exclude  []string `json:"Exclude"`
+	Types    []string `json:"Types"`
+	Validate bool     `json:"Validate"`
+}
+
+// UploadTokenVariable is the environment variable holding the upload token. The token is never read from the configuration file,
+// which sits in the folder served by the server.
+const UploadTokenVariable = "COLAB_UPLOAD_TOKEN"
+
+// uploadStruct is the upload policy expected in the configuration file.
+// Uploads are disabled while Token, read from UploadTokenVariable, is empty. MaxSize is the largest file accepted,
+// and MaxRequestSize the largest request, holding every file uploaded at once, in bytes.
+type uploadStruct struct {
+	Token          string `json:"-"`
+	MaxSize        int64  `json:"MaxSize"`
+	MaxRequestSize int64  `json:"MaxRequestSize"`
 }
 
 // ReadConfig tries to read a file in the provided path.
@@ -63,6 +131,26 @@ func ReadConfig(configPath string) error {
 		}
 
 	}
+	ConfigParams.Upload.Token = os.Getenv(UploadTokenVariable)
+	if len(ConfigParams.Labels) < 2 {
+		return errors.New("at least two Labels must be configured")
+	}
+	seen := map[string]bool{}
+	for _, label := range ConfigParams.Labels {
+		if seen[label] {
+			return errors.New("Label " + label + " is configured more than once")
+		}
+		seen[label] = true
+	}
+	if ConfigParams.LeaseTTL <= 0 {
+		return errors.New("LeaseTTL must be a positive amount of seconds")
+	}
+	if ConfigParams.Upload.MaxRequestSize < ConfigParams.Upload.MaxSize {
+		return errors.New("Upload MaxRequestSize must be at least MaxSize")
+	}
+	if ConfigParams.Completion.Agreement < 0 || ConfigParams.Completion.Agreement > 1 {
+		return errors.New("Completion Agreement must be between 0 and 1")
+	}
 	if ConfigParams.LogLocation == "" {
 		LogFile = os.Stdout
 	} else {
@@ -2,6 +2,7 @@ package config
 
 import (
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
 	"testing"
@@ -118,3 +119,56 @@ func TestLogCreator(t *testing.T) {
 		}
 	}
 }
+
+func TestUploadToken(t *testing.T) {
+	defer os.Remove(testConfigPath)
+	err := ioutil.WriteFile(testConfigPath, []byte(`{"LogLocation": "", "Upload": {"Token": "served", "MaxSize": 10}}`), 0644)
+	if err != nil {
+		log.Fatal("Unable to create Test Settings. Check for permissions.")
+	}
+	os.Unsetenv(UploadTokenVariable)
+	err = ReadConfig(testConfigPath)
+	if err != nil || ConfigParams.Upload.Token != "" || ConfigParams.Upload.MaxSize != 10 {
+		t.Errorf("Expected the token of the configuration file to be ignored, got %+v %v", ConfigParams.Upload, err)
+	}
+	os.Setenv(UploadTokenVariable, "secret")
+	defer os.Unsetenv(UploadTokenVariable)
+	err = ReadConfig(testConfigPath)
+	if err != nil || ConfigParams.Upload.Token != "secret" {
+		t.Errorf("Expected the token to be read from %s, got %+v %v", UploadTokenVariable, ConfigParams.Upload, err)
+	}
+}
+
+func TestLabels(t *testing.T) {
+	defer os.Remove(testConfigPath)
+	defaults := ConfigParams.Labels
+	defer func() { ConfigParams.Labels = defaults }()
+	err := ioutil.WriteFile(testConfigPath, []byte(`{"LogLocation": "", "Labels": ["cat", "dog", "cat"]}`), 0644)
+	if err != nil {
+		log.Fatal("Unable to create Test Settings. Check for permissions.")
+	}
+	if err = ReadConfig(testConfigPath); err == nil {
+		t.Errorf("Expected duplicate Labels to be refused")
+	}
+	err = ioutil.WriteFile(testConfigPath, []byte(`{"LogLocation": "", "Labels": ["cat", "dog", "bird"]}`), 0644)
+	if err != nil {
+		log.Fatal("Unable to create Test Settings. Check for permissions.")
+	}
+	if err = ReadConfig(testConfigPath); err != nil || len(ConfigParams.Labels) != 3 {
+		t.Errorf("Unable to read distinct Labels: %v %v", ConfigParams.Labels, err)
+	}
+}
+
+func TestLeaseTTL(t *testing.T) {
+	defer os.Remove(testConfigPath)
+	defer func(ttl int) { ConfigParams.LeaseTTL = ttl }(ConfigParams.LeaseTTL)
+	for _, ttl := range []string{"0", "-1"} {
+		err := ioutil.WriteFile(testConfigPath, []byte(`{"LogLocation": "", "LeaseTTL": `+ttl+`}`), 0644)
+		if err != nil {
+			log.Fatal("Unable to create Test Settings. Check for permissions.")
+		}
+		if err = ReadConfig(testConfigPath); err == nil {
+			t.Errorf("Expected a LeaseTTL of %s to be refused", ttl)
+		}
+	}
+}
@@ -0,0 +1,546 @@
+package db
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/dgraph-io/badger"
+	bolt "go.etcd.io/bbolt"
+)
+
+// boltBucket is the bucket holding every record of a bbolt store, under the same keys as in Badger.
+var boltBucket = []byte("colab")
+
+// ErrNotEmpty is returned by MigrateBadger when the destination already holds resources.
+var ErrNotEmpty = errors.New("Destination database is not empty")
+
+// boltStore is the Store kept in a single bbolt file. bbolt runs a single write transaction at a time,
+// so updates never conflict and do not need the key locks of Badger.
+type boltStore struct {
+	db    *bolt.DB
+	queue *queue
+}
+
+// OpenBolt opens, or creates, the bbolt database file at databasePath as a Store.
+func OpenBolt(databasePath string) (Store, error) {
+	return openBolt(databasePath)
+}
+
+// openBolt opens a bbolt store, building its scheduling queue from the stored resources.
+func openBolt(databasePath string) (*boltStore, error) {
+	dbpointer, err := bolt.Open(databasePath, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	store := &boltStore{db: dbpointer, queue: newQueue()}
+	err = dbpointer.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(boltBucket)
+		if err != nil {
+			return err
+		}
+		err = boltIterate(bucket, []byte(resourcePrefix), func(key []byte, value []byte) error {
+			resource, err := decodeResource(value)
+			if err != nil {
+				return err
+			}
+			store.queue.set(resource)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, prefix := range []string{recordPrefix, skipPrefix} {
+			err = boltIterate(bucket, []byte(prefix), func(key []byte, _ []byte) error {
+				store.queue.answer(recordOwner(key, prefix))
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		dbpointer.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+// boltIterate calls fn with every key and value starting with prefix, in key order. They are only valid until fn returns.
+func boltIterate(bucket *bolt.Bucket, prefix []byte, fn func(key []byte, value []byte) error) error {
+	cursor := bucket.Cursor()
+	for key, value := cursor.Seek(prefix); key != nil && bytes.HasPrefix(key, prefix); key, value = cursor.Next() {
+		err := fn(key, value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// boltGetResource reads a resource record inside a transaction.
+func boltGetResource(bucket *bolt.Bucket, key string) (Resource, error) {
+	value := bucket.Get(resourceKey(key))
+	if value == nil {
+		return Resource{}, ErrNotFound
+	}
+	return decodeResource(value)
+}
+
+// boltSetResource writes a resource record inside a transaction, refreshing its winning label and completion.
+func boltSetResource(bucket *bolt.Bucket, resource Resource) (Resource, error) {
+	resource.refresh()
+	value, err := json.Marshal(resource)
+	if err != nil {
+		return resource, err
+	}
+	return resource, bucket.Put(resourceKey(resource.Key), value)
+}
+
+// update runs fn inside a write transaction, and moves the resource it wrote inside the scheduling queue once committed.
+func (s *boltStore) update(fn func(bucket *bolt.Bucket) (Resource, error)) error {
+	var resource Resource
+	err := s.db.Update(func(tx *bolt.Tx) (err error) {
+		resource, err = fn(tx.Bucket(boltBucket))
+		return
+	})
+	if err == nil {
+		s.queue.set(resource)
+	}
+	return err
+}
+
+// view runs fn inside a read-only transaction.
+func (s *boltStore) view(fn func(bucket *bolt.Bucket) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		return fn(tx.Bucket(boltBucket))
+	})
+}
+
+// modify applies fn to the resource stored under key.
+func (s *boltStore) modify(key string, fn func(resource *Resource)) error {
+	return s.update(func(bucket *bolt.Bucket) (Resource, error) {
+		resource, err := boltGetResource(bucket, key)
+		if err != nil {
+			return resource, err
+		}
+		fn(&resource)
+		return boltSetResource(bucket, resource)
+	})
+}
+
+func (s *boltStore) InsertResource(key string) error {
+	return s.update(func(bucket *bolt.Bucket) (Resource, error) {
+		if bucket.Get(resourceKey(key)) != nil {
+			return Resource{}, ErrKeyExists
+		}
+		return boltSetResource(bucket, Resource{Key: key, Labels: map[string]int{}})
+	})
+}
+
+func (s *boltStore) InsertFile(key string, hash string) (canonical string, err error) {
+	result := ErrKeyExists
+	err = s.update(func(bucket *bolt.Bucket) (Resource, error) {
+		canonical = string(bucket.Get(hashKey(hash)))
+		if canonical != "" && canonical != key {
+			result = ErrDuplicateContent
+			resource, err := boltGetResource(bucket, canonical)
+			if err != nil {
+				return resource, err
+			}
+			for _, duplicate := range resource.Duplicates {
+				if duplicate == key {
+					return resource, nil
+				}
+			}
+			resource.Duplicates = append(resource.Duplicates, key)
+			sort.Strings(resource.Duplicates)
+			return boltSetResource(bucket, resource)
+		}
+		canonical = key
+		resource, err := boltGetResource(bucket, key)
+		if err == nil && resource.Hash != "" {
+			return resource, nil
+		} else if err == ErrNotFound {
+			result = nil
+			resource = Resource{Key: key, Labels: map[string]int{}}
+		} else if err != nil {
+			return resource, err
+		}
+		resource.Hash = hash
+		err = bucket.Put(hashKey(hash), []byte(key))
+		if err != nil {
+			return resource, err
+		}
+		return boltSetResource(bucket, resource)
+	})
+	if err == nil {
+		err = result
+	}
+	return
+}
+
+func (s *boltStore) GetResource(key string) (resource Resource, err error) {
+	err = s.view(func(bucket *bolt.Bucket) (err error) {
+		resource, err = boltGetResource(bucket, key)
+		return
+	})
+	return
+}
+
+func (s *boltStore) CastVote(record VoteRecord) error {
+	err := s.update(func(bucket *bolt.Bucket) (Resource, error) {
+		resource, err := boltGetResource(bucket, record.Key)
+		if err != nil {
+			return resource, err
+		}
+		if bucket.Get(recordKey(record.Key, record.Annotator)) != nil {
+			return resource, ErrDuplicateVote
+		}
+		value, err := json.Marshal(record)
+		if err != nil {
+			return resource, err
+		}
+		err = bucket.Put(recordKey(record.Key, record.Annotator), value)
+		if err != nil {
+			return resource, err
+		}
+		resource.addVote(record)
+		return boltSetResource(bucket, resource)
+	})
+	if err == nil {
+		s.queue.answer(record.Key, record.Annotator)
+	}
+	return err
+}
+
+func (s *boltStore) RetractVote(key string, annotator string) (record VoteRecord, err error) {
+	err = s.update(func(bucket *bolt.Bucket) (Resource, error) {
+		value := bucket.Get(recordKey(key, annotator))
+		if value == nil {
+			return Resource{}, ErrVoteNotFound
+		}
+		err := json.Unmarshal(value, &record)
+		if err != nil {
+			return Resource{}, err
+		}
+		resource, err := boltGetResource(bucket, key)
+		if err != nil {
+			return resource, err
+		}
+		resource.removeVote(record)
+		err = bucket.Delete(recordKey(key, annotator))
+		if err != nil {
+			return resource, err
+		}
+		return boltSetResource(bucket, resource)
+	})
+	if err == nil {
+		s.queue.unanswer(key, annotator)
+	}
+	return
+}
+
+func (s *boltStore) SkipResource(record SkipRecord) error {
+	if record.Reason == "" {
+		record.Reason = "unspecified"
+	} else if !validReason(record.Reason) {
+		return ErrUnknownReason
+	}
+	err := s.update(func(bucket *bolt.Bucket) (Resource, error) {
+		resource, err := boltGetResource(bucket, record.Key)
+		if err != nil {
+			return resource, err
+		}
+		if bucket.Get(skipKey(record.Key, record.Annotator)) != nil {
+			return resource, ErrDuplicateSkip
+		}
+		value, err := json.Marshal(record)
+		if err != nil {
+			return resource, err
+		}
+		err = bucket.Put(skipKey(record.Key, record.Annotator), value)
+		if err != nil {
+			return resource, err
+		}
+		resource.addSkip(record)
+		return boltSetResource(bucket, resource)
+	})
+	if err == nil {
+		s.queue.answer(record.Key, record.Annotator)
+	}
+	return err
+}
+
+// boltVoteRecords reads the votes cast on key inside a transaction.
+func boltVoteRecords(bucket *bolt.Bucket, key string) (list []VoteRecord, err error) {
+	err = boltIterate(bucket, recordKey(key, ""), func(_ []byte, value []byte) error {
+		var record VoteRecord
+		err := json.Unmarshal(value, &record)
+		if err != nil {
+			return err
+		}
+		list = append(list, record)
+		return nil
+	})
+	return
+}
+
+func (s *boltStore) GetVoteRecords(key string) (list []VoteRecord, err error) {
+	err = s.view(func(bucket *bolt.Bucket) (err error) {
+		list, err = boltVoteRecords(bucket, key)
+		return
+	})
+	return
+}
+
+func (s *boltStore) GetSortedKey(annotator string) (string, error) {
+	return s.GetNewSortedKey("", annotator)
+}
+
+func (s *boltStore) GetNewSortedKey(lastkey string, annotator string) (string, error) {
+	key, ok := s.queue.next(lastkey, annotator, LeaseTTL)
+	if !ok {
+		return "", ErrNotFound
+	}
+	return key, nil
+}
+
+func (s *boltStore) CountDBSize() (value int) {
+	_ = s.view(func(bucket *bolt.Bucket) error {
+		return boltIterate(bucket, []byte(resourcePrefix), func(_ []byte, _ []byte) error {
+			value++
+			return nil
+		})
+	})
+	return
+}
+
+func (s *boltStore) GetCurrentVotes() (list []Resource, err error) {
+	err = s.view(func(bucket *bolt.Bucket) error {
+		return boltIterate(bucket, []byte(resourcePrefix), func(_ []byte, value []byte) error {
+			resource, err := decodeResource(value)
+			if err != nil {
+				return err
+			}
+			list = append(list, resource)
+			return nil
+		})
+	})
+	return
+}
+
+func (s *boltStore) IterateResources(fn func(resource Resource, votes []VoteRecord) error) error {
+	return s.view(func(bucket *bolt.Bucket) error {
+		return boltIterate(bucket, []byte(resourcePrefix), func(_ []byte, value []byte) error {
+			resource, err := decodeResource(value)
+			if err != nil {
+				return err
+			}
+			votes, err := boltVoteRecords(bucket, resource.Key)
+			if err != nil {
+				return err
+			}
+			return fn(resource, votes)
+		})
+	})
+}
+
+func (s *boltStore) GetDuplicates() (groups []DuplicateGroup, err error) {
+	err = s.IterateResources(func(resource Resource, votes []VoteRecord) error {
+		if len(resource.Duplicates) > 0 {
+			groups = append(groups, DuplicateGroup{Hash: resource.Hash, Canonical: resource.Key, Duplicates: resource.Duplicates})
+		}
+		return nil
+	})
+	return
+}
+
+func (s *boltStore) SetPerceptualHash(key string, hash string) error {
+	return s.modify(key, func(resource *Resource) { resource.PerceptualHash = hash })
+}
+
+func (s *boltStore) SetMetadata(key string, metadata Metadata) error {
+	return s.modify(key, func(resource *Resource) { resource.Metadata = &metadata })
+}
+
+func (s *boltStore) SetOrphaned(key string, orphaned bool) error {
+	return s.modify(key, func(resource *Resource) { resource.Orphaned = orphaned })
+}
+
+func (s *boltStore) SetPrior(key string, prior map[string]int, positive string, priority int) error {
+	return s.modify(key, func(resource *Resource) { resource.setPrior(prior, positive, priority) })
+}
+
+func (s *boltStore) RemoveDuplicate(key string, path string) error {
+	return s.modify(key, func(resource *Resource) { resource.removeDuplicate(path) })
+}
+
+func (s *boltStore) ReplaceContent(key string, hash string) (duplicates []string, err error) {
+	err = s.update(func(bucket *bolt.Bucket) (Resource, error) {
+		resource, err := boltGetResource(bucket, key)
+		if err != nil || resource.Hash == hash {
+			return resource, err
+		}
+		if resource.Hash != "" && string(bucket.Get(hashKey(resource.Hash))) == key {
+			err = bucket.Delete(hashKey(resource.Hash))
+			if err != nil {
+				return resource, err
+			}
+		}
+		if bucket.Get(hashKey(hash)) == nil {
+			err = bucket.Put(hashKey(hash), []byte(key))
+			if err != nil {
+				return resource, err
+			}
+		}
+		duplicates = resource.replaceContent(hash)
+		return boltSetResource(bucket, resource)
+	})
+	return
+}
+
+func (s *boltStore) RenameResource(oldKey string, newKey string) error {
+	err := s.update(func(bucket *bolt.Bucket) (Resource, error) {
+		resource, err := boltGetResource(bucket, oldKey)
+		if err != nil {
+			return resource, err
+		}
+		if bucket.Get(resourceKey(newKey)) != nil {
+			return resource, ErrKeyExists
+		}
+		err = boltMoveRecords(bucket, recordKey(oldKey, ""), recordKey(newKey, ""), newKey)
+		if err != nil {
+			return resource, err
+		}
+		err = boltMoveRecords(bucket, skipKey(oldKey, ""), skipKey(newKey, ""), newKey)
+		if err != nil {
+			return resource, err
+		}
+		err = bucket.Delete(resourceKey(oldKey))
+		if err != nil {
+			return resource, err
+		}
+		if resource.Hash != "" {
+			err = bucket.Put(hashKey(resource.Hash), []byte(newKey))
+			if err != nil {
+				return resource, err
+			}
+		}
+		resource.Key = newKey
+		resource.removeDuplicate(newKey)
+		resource.Orphaned = false
+		return boltSetResource(bucket, resource)
+	})
+	if err == nil {
+		s.queue.rename(oldKey, newKey)
+	}
+	return err
+}
+
+// boltMoveRecords moves every vote or skip record stored under oldPrefix to newPrefix, updating the key they hold.
+// Records are read before being moved, since a bucket can not be changed while a cursor walks it.
+func boltMoveRecords(bucket *bolt.Bucket, oldPrefix []byte, newPrefix []byte, newKey string) error {
+	var keys, values [][]byte
+	err := boltIterate(bucket, oldPrefix, func(key []byte, value []byte) error {
+		keys = append(keys, append([]byte{}, key...))
+		values = append(values, append([]byte{}, value...))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for i, key := range keys {
+		var record map[string]interface{}
+		err := json.Unmarshal(values[i], &record)
+		if err != nil {
+			return err
+		}
+		record["Key"] = newKey
+		value, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		err = bucket.Delete(key)
+		if err != nil {
+			return err
+		}
+		err = bucket.Put(append(append([]byte{}, newPrefix...), bytes.TrimPrefix(key, oldPrefix)...), value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *boltStore) Close() error { return s.db.Close() }
+
+// MigrateBadger copies every record of the Badger database at badgerPath into the bbolt file at boltPath, which is created
+// if needed and must not hold any resource yet. The Badger database is left untouched. It returns the amount of resources copied.
+// Only the resource, vote, skip and hash records are copied, so keys of the legacy format, which UpgradeLegacy converts, are left behind.
+func MigrateBadger(badgerPath string, boltPath string) (resources int, err error) {
+	if _, err = os.Stat(badgerPath); err != nil {
+		return
+	}
+	source, err := Init(badgerPath)
+	if err != nil {
+		return
+	}
+	defer Close(source)
+	destination, err := openBolt(boltPath)
+	if err != nil {
+		return
+	}
+	defer destination.Close()
+	if destination.CountDBSize() > 0 {
+		return 0, ErrNotEmpty
+	}
+	// records are copied in batches, so a large database does not end up in a single bbolt transaction
+	const batchSize = 1000
+	var keys, values [][]byte
+	flush := func() error {
+		err := destination.db.Update(func(tx *bolt.Tx) error {
+			bucket := tx.Bucket(boltBucket)
+			for i := range keys {
+				err := bucket.Put(keys[i], values[i])
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		keys, values = nil, nil
+		return err
+	}
+	err = source.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			if legacyKey(it.Item().Key()) {
+				continue
+			}
+			value, err := it.Item().ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			if bytes.HasPrefix(it.Item().Key(), []byte(resourcePrefix)) {
+				resources++
+			}
+			keys = append(keys, it.Item().KeyCopy(nil))
+			values = append(values, value)
+			if len(keys) == batchSize {
+				err = flush()
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return flush()
+	})
+	return
+}
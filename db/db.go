@@ -1,13 +1,16 @@
 // Package db manages voting storage for.
 // The storage is performed by a Key-Value community database called Badger.
+// Every resource is stored as a single record holding its score, amount of votes and label tallies,
+// next to the records of the votes cast on it, so both can be updated in the same transaction.
+// The server uses it through the Store interface, which is also implemented in memory for tests.
 package db
 
 import (
-	"encoding/binary"
+	"encoding/json"
 	"errors"
-	"fmt"
+	"hash/fnv"
 	"math/rand"
-	"sort"
+	"sync"
 	"time"
 
 	"github.com/dgraph-io/badger"
@@ -16,10 +19,62 @@ import (
 
 var colabOpts badger.Options
 
+const (
+	// resourcePrefix namespaces the resource records inside the database.
+	resourcePrefix = "res:"
+	// recordPrefix namespaces the vote records inside the database.
+	recordPrefix = "vote:"
+	// skipPrefix namespaces the skip records inside the database.
+	skipPrefix = "skip:"
+	// hashPrefix namespaces the index from content hashes to the resource holding that content.
+	hashPrefix = "hash:"
+)
+
+// SkipReasons lists the reasons an annotator can give when skipping a resource. Skips without a reason are recorded as "unspecified".
+var SkipReasons = []string{"unclear", "broken", "offensive"}
+
+var (
+	// ErrKeyExists is returned when inserting a resource that is already in the database.
+	ErrKeyExists = errors.New("Key Exists")
+	// ErrDuplicateVote is returned when an annotator tries to vote twice on the same key.
+	ErrDuplicateVote = errors.New("Annotator already voted on this key")
+	// ErrVoteNotFound is returned when an annotator tries to retract a vote they did not cast.
+	ErrVoteNotFound = errors.New("Annotator has no vote on this key")
+	// ErrDuplicateSkip is returned when an annotator tries to skip the same key twice.
+	ErrDuplicateSkip = errors.New("Annotator already skipped this key")
+	// ErrUnknownReason is returned when skipping with a reason that is not in SkipReasons.
+	ErrUnknownReason = errors.New("Unknown skip reason")
+)
+
 // Vote strcucture used to process voting from the API with strings instead of numbers. This is intended to make voting safer, and avoid requests with a value bigger than 1.
 type Vote struct {
-	Key  string `json:"Key"`
-	Vote string `json:"Vote"`
+	Key       string `json:"Key"`
+	Vote      string `json:"Vote"`
+	Annotator string `json:"Annotator"`
+}
+
+// VoteRecord structure stores a single vote cast by an annotator, including the score it added to the resource.
+type VoteRecord struct {
+	Annotator string    `json:"Annotator"`
+	Key       string    `json:"Key"`
+	Label     string    `json:"Label"`
+	Score     int       `json:"Score"`
+	Timestamp time.Time `json:"Timestamp"`
+}
+
+// Skip structure used to process skips from the API, for pictures an annotator can not tell.
+type Skip struct {
+	Key       string `json:"Key"`
+	Annotator string `json:"Annotator"`
+	Reason    string `json:"Reason"`
+}
+
+// SkipRecord structure stores a single skip made by an annotator.
+type SkipRecord struct {
+	Annotator string    `json:"Annotator"`
+	Key       string    `json:"Key"`
+	Reason    string    `json:"Reason"`
+	Timestamp time.Time `json:"Timestamp"`
 }
 
 // VoteInt structure used to process votes inside the API, including sorting.
@@ -28,17 +83,102 @@ type VoteInt struct {
 	Vote int    `json:"Vote"`
 }
 
-// VoteIntAmt structure is used to merge data from both databases (Votes and Amount of Votes)
-type VoteIntAmt struct {
-	Key        string `json:"Key"`
-	Vote       int    `json:"Vote"`
-	TotalVotes int    `json"TotalVotes"`
+// Resource structure is the record stored for every key, holding its score (Vote), amount of votes, label tallies and skips per reason.
+// Finalized resources reached the CompletionPolicy, and Flagged resources were skipped too many times. Neither are scheduled anymore.
+// Hash is the SHA-256 of the file content, and Duplicates lists the other paths holding the same content, which are not voted on their own.
+// PerceptualHash is the difference hash of pictures, which stays close for resized or re-encoded copies.
+// Orphaned resources lost their file, and are not scheduled until it comes back, keeping their votes.
+// Metadata describes the file, when the builder could read it.
+// Prior holds the label counts seeded by an import, already included in Vote, TotalVotes and Labels, and resources with a higher Priority are scheduled first.
+type Resource struct {
+	Key            string         `json:"Key"`
+	Vote           int            `json:"Vote"`
+	TotalVotes     int            `json:"TotalVotes"`
+	Labels         map[string]int `json:"Labels"`
+	Winner         string         `json:"Winner"`
+	Finalized      bool           `json:"Finalized"`
+	Skips          map[string]int `json:"Skips"`
+	Flagged        bool           `json:"Flagged"`
+	Hash           string         `json:"Hash,omitempty"`
+	Duplicates     []string       `json:"Duplicates,omitempty"`
+	PerceptualHash string         `json:"PerceptualHash,omitempty"`
+	Orphaned       bool           `json:"Orphaned,omitempty"`
+	Metadata       *Metadata      `json:"Metadata,omitempty"`
+	Prior          map[string]int `json:"Prior,omitempty"`
+	Priority       int            `json:"Priority,omitempty"`
+}
+
+// Metadata structure describes the file of a resource. Width, Height and Format are only known for pictures,
+// and Taken, Camera and Orientation only for pictures holding those EXIF fields.
+type Metadata struct {
+	Width       int        `json:"Width,omitempty"`
+	Height      int        `json:"Height,omitempty"`
+	Format      string     `json:"Format,omitempty"`
+	Size        int64      `json:"Size"`
+	Modified    time.Time  `json:"Modified"`
+	Taken       *time.Time `json:"Taken,omitempty"`
+	Camera      string     `json:"Camera,omitempty"`
+	Orientation int        `json:"Orientation,omitempty"`
+}
+
+// Aspect returns the width of the picture divided by its height, or 0 when its dimensions are unknown.
+func (m Metadata) Aspect() float64 {
+	if m.Height == 0 {
+		return 0
+	}
+	return float64(m.Width) / float64(m.Height)
+}
+
+// refresh recomputes the fields derived from the label and skip tallies, so they follow the current CompletionPolicy.
+func (r *Resource) refresh() {
+	r.Winner = Winner(r.Labels)
+	r.Finalized = CompletionPolicy.Done(*r)
+	r.Flagged = CompletionPolicy.Flagged(*r)
+}
+
+// addVote applies a vote to the score, amount of votes and label tallies.
+func (r *Resource) addVote(record VoteRecord) {
+	if r.Labels == nil {
+		r.Labels = map[string]int{}
+	}
+	r.Vote += record.Score
+	r.TotalVotes++
+	r.Labels[record.Label]++
+}
+
+// removeVote undoes a vote applied by addVote.
+func (r *Resource) removeVote(record VoteRecord) {
+	r.Vote -= record.Score
+	r.TotalVotes--
+	r.Labels[record.Label]--
+	if r.Labels[record.Label] <= 0 {
+		delete(r.Labels, record.Label)
+	}
+}
+
+// addSkip counts a skip under its reason.
+func (r *Resource) addSkip(record SkipRecord) {
+	if r.Skips == nil {
+		r.Skips = map[string]int{}
+	}
+	r.Skips[record.Reason]++
+}
+
+// scheduled reports whether a resource should still be handed to annotators.
+func (r Resource) scheduled() bool {
+	return !r.Finalized && !r.Flagged && !r.Orphaned
+}
+
+// decodeResource reads a stored resource record.
+func decodeResource(val []byte) (resource Resource, err error) {
+	err = json.Unmarshal(val, &resource)
+	resource.refresh()
+	return
 }
 
 // Init takes a path as input and reads / creates a bBadger database .
 func Init(databasePath string) (*badger.DB, error) {
-	dbinfo := fmt.Sprintf(databasePath)
-	return connectDB(dbinfo)
+	return connectDB(databasePath)
 }
 
 // connectDB manages the database connection and configuration.
@@ -59,148 +199,279 @@ func connectDB(databasePath string) (*badger.DB, error) {
 	return db, nil
 }
 
-// InsertResource is a simple querry that inserts/updates the Resource tuple used by .
-func InsertResource(key string, vote int, dbpointer *badger.DB) error {
-	// Check if key existis
-	_, err := GetResourceValue(key, dbpointer)
-	if err == nil {
-		return errors.New("Key Exists")
+// Close drops the in-memory state kept for a database and closes it.
+func Close(dbpointer *badger.DB) error {
+	forgetQueue(dbpointer)
+	return dbpointer.Close()
+}
+
+// resourceKey builds the storage key of a resource.
+func resourceKey(key string) []byte {
+	return []byte(resourcePrefix + key)
+}
+
+// recordKey builds the storage key of the vote an annotator cast on a resource.
+func recordKey(key string, annotator string) []byte {
+	return []byte(recordPrefix + key + "\x00" + annotator)
+}
+
+// keyLocks serializes read-modify-write transactions on the same resource.
+// Badger only checks conflicts against commits newer than the transaction read timestamp, and a commit still being
+// applied may already be older than it, so two updates racing on a freshly written value could both succeed.
+var keyLocks [256]sync.Mutex
+
+// lockFor returns the lock guarding the updates of key.
+func lockFor(key string) *sync.Mutex {
+	return &keyLocks[lockIndex(key)]
+}
+
+// lockIndex returns the position of the lock guarding the updates of key inside keyLocks.
+func lockIndex(key string) int {
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	return int(hash.Sum32() % uint32(len(keyLocks)))
+}
+
+// update runs fn inside a read-write transaction on key, retrying it whenever the commit conflicts with a concurrent one.
+// fn returns the resource record it wrote, which is moved inside the scheduling queue once the transaction is committed.
+func update(dbpointer *badger.DB, key string, fn func(txn *badger.Txn) (Resource, error)) error {
+	lock := lockFor(key)
+	lock.Lock()
+	defer lock.Unlock()
+	for {
+		var resource Resource
+		err := dbpointer.Update(func(txn *badger.Txn) (err error) {
+			resource, err = fn(txn)
+			return
+		})
+		if err == nil {
+			queueFor(dbpointer).set(resource)
+		}
+		if err != badger.ErrConflict {
+			return err
+		}
 	}
-	return dbpointer.Update(func(txn *badger.Txn) error {
-		value := make([]byte, 4)
-		binary.PutVarint(value, int64(vote))
-		err := txn.Set([]byte(key), value)
-		return err
-	})
 }
 
-// UpdateResource is a simple querry that inserts/updates the Resource tuple.
-func UpdateResource(key string, vote int, dbpointer *badger.DB) error {
-	oldval, err := GetResourceValue(key, dbpointer)
+// getResource reads a resource record inside a transaction.
+func getResource(txn *badger.Txn, key string) (resource Resource, err error) {
+	item, err := txn.Get(resourceKey(key))
 	if err != nil {
-		return err
+		return
 	}
-	return dbpointer.Update(func(txn *badger.Txn) error {
-		value := make([]byte, 4)
-		binary.PutVarint(value, int64(oldval+vote))
-		err := txn.Set([]byte(key), value)
-		return err
+	val, err := item.Value()
+	if err != nil {
+		return
+	}
+	return decodeResource(val)
+}
+
+// setResource writes a resource record inside a transaction, refreshing its winning label and completion.
+func setResource(txn *badger.Txn, resource Resource) (Resource, error) {
+	resource.refresh()
+	value, err := json.Marshal(resource)
+	if err != nil {
+		return resource, err
+	}
+	return resource, txn.Set(resourceKey(resource.Key), value)
+}
+
+// InsertResource creates an empty record for key, failing with ErrKeyExists if it is already in the database.
+func InsertResource(key string, dbpointer *badger.DB) error {
+	return update(dbpointer, key, func(txn *badger.Txn) (Resource, error) {
+		_, err := txn.Get(resourceKey(key))
+		if err == nil {
+			return Resource{}, ErrKeyExists
+		} else if err != badger.ErrKeyNotFound {
+			return Resource{}, err
+		}
+		return setResource(txn, Resource{Key: key, Labels: map[string]int{}})
 	})
 }
 
-// GetResourceValue returns the value of a specified resource
-func GetResourceValue(key string, dbpointer *badger.DB) (value int, err error) {
-	var result int64
+// GetResource returns the record of a specified resource
+func GetResource(key string, dbpointer *badger.DB) (resource Resource, err error) {
 	err = dbpointer.View(func(txn *badger.Txn) error {
-		item, err := txn.Get([]byte(key))
+		resource, err = getResource(txn, key)
+		return err
+	})
+	return
+}
+
+// CastVote persists a vote record and applies it to the resource in a single transaction, releasing the lease the annotator held on it.
+// It fails with ErrDuplicateVote if the annotator already voted on the key, and with badger.ErrKeyNotFound if the key does not exist.
+func CastVote(record VoteRecord, dbpointer *badger.DB) error {
+	err := update(dbpointer, record.Key, func(txn *badger.Txn) (Resource, error) {
+		resource, err := getResource(txn, record.Key)
 		if err != nil {
-			return err
+			return resource, err
+		}
+		_, err = txn.Get(recordKey(record.Key, record.Annotator))
+		if err == nil {
+			return resource, ErrDuplicateVote
+		} else if err != badger.ErrKeyNotFound {
+			return resource, err
 		}
-		var val []byte
-		val, err = item.ValueCopy(val)
+		value, err := json.Marshal(record)
 		if err != nil {
-			return err
+			return resource, err
 		}
-		var berr int
-		result, berr = binary.Varint(val)
-		if berr == 0 {
-			return errors.New("Failed to Read Binary")
+		err = txn.Set(recordKey(record.Key, record.Annotator), value)
+		if err != nil {
+			return resource, err
 		}
-		//copy(result, val)
-		return err
+		resource.addVote(record)
+		return setResource(txn, resource)
 	})
-
-	return int(result), err
+	if err == nil {
+		queueFor(dbpointer).answer(record.Key, record.Annotator)
+	}
+	return err
 }
 
-// GetRandomKey returns a random key from the database
-func GetRandomKey(dbpointer *badger.DB, dbsize int) (value string, err error) {
-	rcount := rand.New(rand.NewSource(time.Now().Unix())).Intn(dbsize)
-	err = dbpointer.View(func(txn *badger.Txn) error {
-		opts := badger.DefaultIteratorOptions
-		opts.PrefetchValues = false
-		it := txn.NewIterator(opts)
-		defer it.Close()
-		acount := 0
-		for it.Rewind(); it.Valid(); it.Next() {
-			if acount == rcount {
-				item := it.Item()
-				k := item.Key()
-				value = string(k)
-				return nil
-			} else {
-				acount++
-			}
+// RetractVote removes the vote an annotator cast on a key, undoes it on the resource and returns it.
+// It fails with ErrVoteNotFound if the annotator did not vote on the key.
+func RetractVote(key string, annotator string, dbpointer *badger.DB) (record VoteRecord, err error) {
+	err = update(dbpointer, key, func(txn *badger.Txn) (Resource, error) {
+		item, err := txn.Get(recordKey(key, annotator))
+		if err == badger.ErrKeyNotFound {
+			return Resource{}, ErrVoteNotFound
+		} else if err != nil {
+			return Resource{}, err
 		}
-		return nil
+		val, err := item.Value()
+		if err != nil {
+			return Resource{}, err
+		}
+		err = json.Unmarshal(val, &record)
+		if err != nil {
+			return Resource{}, err
+		}
+		resource, err := getResource(txn, key)
+		if err != nil {
+			return resource, err
+		}
+		resource.removeVote(record)
+		err = txn.Delete(recordKey(key, annotator))
+		if err != nil {
+			return resource, err
+		}
+		return setResource(txn, resource)
 	})
+	if err == nil {
+		queueFor(dbpointer).unanswer(key, annotator)
+	}
 	return
 }
 
-// GetSortedKey will return the key with the smallest value
-func GetSortedKey(dbpointer *badger.DB) (topKey string, err error) {
-	rcount := rand.New(rand.NewSource(time.Now().Unix())).Intn(2)
-	var list []VoteInt
-	err = dbpointer.View(func(txn *badger.Txn) error {
-		opts := badger.DefaultIteratorOptions
-		opts.PrefetchSize = 70000
-		if rcount == 1 {
-			opts.Reverse = true
+// skipKey builds the storage key of the skip an annotator made on a resource.
+func skipKey(key string, annotator string) []byte {
+	return []byte(skipPrefix + key + "\x00" + annotator)
+}
+
+// SkipResource records that an annotator skipped a key without changing its score, and releases the lease they held on it.
+// It fails with ErrDuplicateSkip if the annotator already skipped the key, and with badger.ErrKeyNotFound if the key does not exist.
+func SkipResource(record SkipRecord, dbpointer *badger.DB) error {
+	if record.Reason == "" {
+		record.Reason = "unspecified"
+	} else if !validReason(record.Reason) {
+		return ErrUnknownReason
+	}
+	err := update(dbpointer, record.Key, func(txn *badger.Txn) (Resource, error) {
+		resource, err := getResource(txn, record.Key)
+		if err != nil {
+			return resource, err
 		}
-		it := txn.NewIterator(opts)
+		_, err = txn.Get(skipKey(record.Key, record.Annotator))
+		if err == nil {
+			return resource, ErrDuplicateSkip
+		} else if err != badger.ErrKeyNotFound {
+			return resource, err
+		}
+		value, err := json.Marshal(record)
+		if err != nil {
+			return resource, err
+		}
+		err = txn.Set(skipKey(record.Key, record.Annotator), value)
+		if err != nil {
+			return resource, err
+		}
+		resource.addSkip(record)
+		return setResource(txn, resource)
+	})
+	if err == nil {
+		queueFor(dbpointer).answer(record.Key, record.Annotator)
+	}
+	return err
+}
+
+// validReason reports whether reason is one of the SkipReasons.
+func validReason(reason string) bool {
+	for _, r := range SkipReasons {
+		if r == reason {
+			return true
+		}
+	}
+	return false
+}
+
+// GetVoteRecords returns every vote cast on a key.
+func GetVoteRecords(key string, dbpointer *badger.DB) (list []VoteRecord, err error) {
+	err = dbpointer.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
 		defer it.Close()
-		for it.Rewind(); it.Valid(); it.Next() {
-			item := it.Item()
-			k := item.Key()
-			var v []byte
-			v, err := item.ValueCopy(v)
+		prefix := recordKey(key, "")
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			val, err := it.Item().Value()
+			if err != nil {
+				return err
+			}
+			var record VoteRecord
+			err = json.Unmarshal(val, &record)
 			if err != nil {
 				return err
 			}
-			result, _ := binary.Varint(v)
-			list = append(list, VoteInt{string(k), int(result)})
+			list = append(list, record)
 		}
 		return nil
 	})
-	sort.Slice(list, func(i, j int) bool {
-		return list[i].Vote < list[j].Vote
-	})
-	topKey = list[0].Key
 	return
 }
 
-// GetNewSortedKey will return the key with the smallest value and different from the provided one
-func GetNewSortedKey(dbpointer *badger.DB, lastkey string) (topKey string, err error) {
-	rcount := rand.New(rand.NewSource(time.Now().Unix())).Intn(2)
-	var list []VoteInt
+// GetRandomKey returns a random key from the database
+func GetRandomKey(dbpointer *badger.DB, dbsize int) (value string, err error) {
+	rcount := rand.New(rand.NewSource(time.Now().Unix())).Intn(dbsize)
 	err = dbpointer.View(func(txn *badger.Txn) error {
 		opts := badger.DefaultIteratorOptions
-		opts.PrefetchSize = 70000
-		if rcount == 1 {
-			opts.Reverse = true
-		}
+		opts.PrefetchValues = false
 		it := txn.NewIterator(opts)
 		defer it.Close()
-		for it.Rewind(); it.Valid(); it.Next() {
-			item := it.Item()
-			k := item.Key()
-			var v []byte
-			v, err := item.ValueCopy(v)
-			if err != nil {
-				return err
+		acount := 0
+		prefix := []byte(resourcePrefix)
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			if acount == rcount {
+				value = string(it.Item().Key()[len(prefix):])
+				return nil
 			}
-			result, _ := binary.Varint(v)
-			list = append(list, VoteInt{string(k), int(result)})
+			acount++
 		}
 		return nil
 	})
-	sort.Slice(list, func(i, j int) bool {
-		return list[i].Vote < list[j].Vote
-	})
-	if lastkey == list[0].Key {
-		topKey = list[1].Key
-	} else {
-		topKey = list[0].Key
+	return
+}
+
+// GetSortedKey will return the key with the smallest value, leasing it to annotator for LeaseTTL so it is not handed to anyone else.
+// Annotators already holding a lease get the same key back.
+func GetSortedKey(dbpointer *badger.DB, annotator string) (topKey string, err error) {
+	return GetNewSortedKey(dbpointer, "", annotator)
+}
+
+// GetNewSortedKey will return the key with the smallest value and different from the provided one, leasing it to annotator.
+// The lease annotator held on the provided key is released.
+func GetNewSortedKey(dbpointer *badger.DB, lastkey string, annotator string) (topKey string, err error) {
+	topKey, ok := queueFor(dbpointer).next(lastkey, annotator, LeaseTTL)
+	if !ok {
+		return "", badger.ErrKeyNotFound
 	}
 	return
 }
@@ -212,8 +483,8 @@ func CountDBSize(dbpointer *badger.DB) (value int) {
 		opts.PrefetchValues = false
 		it := txn.NewIterator(opts)
 		defer it.Close()
-		for it.Rewind(); it.Valid(); it.Next() {
-			// item := it.Item()
+		prefix := []byte(resourcePrefix)
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
 			value++
 		}
 		return nil
@@ -221,26 +492,83 @@ func CountDBSize(dbpointer *badger.DB) (value int) {
 	return
 }
 
-// GetCurrentVotes will return a list of the votes in the database.
-func GetCurrentVotes(dbpointer *badger.DB) (list []VoteInt, err error) {
-	// list := make(chan struct {string; string})
+// GetCurrentVotes will return a list of the resources in the database.
+func GetCurrentVotes(dbpointer *badger.DB) (list []Resource, err error) {
 	err = dbpointer.View(func(txn *badger.Txn) error {
 		opts := badger.DefaultIteratorOptions
 		opts.PrefetchSize = 10
 		it := txn.NewIterator(opts)
 		defer it.Close()
-		for it.Rewind(); it.Valid(); it.Next() {
-			item := it.Item()
-			k := item.Key()
-			var v []byte
-			v, err := item.ValueCopy(v)
+		prefix := []byte(resourcePrefix)
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			val, err := it.Item().Value()
+			if err != nil {
+				return err
+			}
+			resource, err := decodeResource(val)
 			if err != nil {
 				return err
 			}
-			result, _ := binary.Varint(v)
-			list = append(list, VoteInt{string(k), int(result)})
+			list = append(list, resource)
 		}
 		return nil
 	})
 	return
 }
+
+// IterateResources calls fn with every resource in the database and the votes cast on it, in key order, without loading them all in memory.
+// Iteration stops at the first error returned by fn.
+func IterateResources(dbpointer *badger.DB, fn func(resource Resource, votes []VoteRecord) error) error {
+	return dbpointer.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchSize = 10
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		prefix := []byte(resourcePrefix)
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			val, err := it.Item().Value()
+			if err != nil {
+				return err
+			}
+			resource, err := decodeResource(val)
+			if err != nil {
+				return err
+			}
+			// transactions hold a single iterator, so it visits the votes and then seeks back to the resource
+			var votes []VoteRecord
+			recordsPrefix := recordKey(resource.Key, "")
+			for it.Seek(recordsPrefix); it.ValidForPrefix(recordsPrefix); it.Next() {
+				val, err := it.Item().Value()
+				if err != nil {
+					return err
+				}
+				var record VoteRecord
+				err = json.Unmarshal(val, &record)
+				if err != nil {
+					return err
+				}
+				votes = append(votes, record)
+			}
+			it.Seek(resourceKey(resource.Key))
+			err = fn(resource, votes)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Winner returns the label with the most votes. Ties and empty tallies have no winner and return an empty string.
+func Winner(counts map[string]int) (winner string) {
+	best := 0
+	for label, amount := range counts {
+		if amount > best {
+			best = amount
+			winner = label
+		} else if amount == best {
+			winner = ""
+		}
+	}
+	return
+}
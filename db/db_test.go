@@ -1,19 +1,30 @@
 package db
 
 import (
+	"encoding/binary"
+	"encoding/json"
 	"log"
 	"os"
+	"sort"
+	"strconv"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger"
+	bolt "go.etcd.io/bbolt"
 )
 
 const (
 	dbPath     = "./fastgate.db_test.go.db"
+	boltPath   = "./fastgate.db_test.go.bolt"
 	testKey    = "TestKey"
-	testValue  = 500
-	testValue2 = -500
+	testValue  = 1
+	testValue2 = -1
 )
 
-func TestDatabase(t *testing.T) {
+// initTestDatabase creates an empty database at dbPath, removing any leftovers from previous runs.
+func initTestDatabase(t *testing.T) *badger.DB {
 	if _, err := os.Stat(dbPath); !os.IsNotExist(err) {
 		err = os.RemoveAll(dbPath)
 		if err != nil {
@@ -23,47 +34,1025 @@ func TestDatabase(t *testing.T) {
 	datab, err := Init(dbPath)
 	if err != nil {
 		t.Errorf("Unable to Init Database")
+		t.FailNow()
+	}
+	return datab
+}
+
+// closeTestDatabase closes and removes the database created by initTestDatabase.
+func closeTestDatabase(t *testing.T, datab *badger.DB) {
+	err := Close(datab)
+	if err != nil {
+		t.Errorf("Failed at Closing Database")
+	}
+	err = os.RemoveAll(dbPath)
+	if err != nil {
+		log.Printf("Unable to clean Test Database Aftere test. Check for permissions, and remove foleder '%s' or Future Tests might Fail", dbPath)
 	}
-	err = InsertResource(testKey, testValue, datab)
+}
+
+func TestDatabase(t *testing.T) {
+	datab := initTestDatabase(t)
+	defer closeTestDatabase(t, datab)
+	err := InsertResource(testKey, datab)
 	if err != nil {
 		t.Errorf("Unable to Insert Tuple")
 		t.FailNow()
 	}
-	value, err := GetResourceValue(testKey, datab)
+	err = InsertResource(testKey, datab)
+	if err != ErrKeyExists {
+		t.Errorf("Inserting the same Tuple twice should fail with ErrKeyExists")
+	}
+	resource, err := GetResource(testKey, datab)
 	if err != nil {
 		t.Errorf("Unable to Fetch Tuple")
 		t.FailNow()
 
 	}
-	if value != testValue {
+	if resource.Key != testKey || resource.Vote != 0 || resource.TotalVotes != 0 {
 		t.Errorf("Received Value not mathing with what was inserted.")
 		t.FailNow()
 
 	}
-	err = UpdateResource(testKey, testValue2, datab)
+	err = CastVote(VoteRecord{Annotator: "alice", Key: testKey, Label: "true", Score: testValue}, datab)
+	if err != nil {
+		t.Errorf("Unable to Update Tuple")
+		t.FailNow()
+	}
+	err = CastVote(VoteRecord{Annotator: "bob", Key: testKey, Label: "false", Score: testValue2}, datab)
 	if err != nil {
 		t.Errorf("Unable to Update Tuple")
 		t.FailNow()
 	}
-	value, err = GetResourceValue(testKey, datab)
+	resource, err = GetResource(testKey, datab)
 	if err != nil {
 		t.Errorf("Unable to Fetch Tuple after Updating")
 		t.FailNow()
 
 	}
-	if value != testValue+testValue2 {
+	if resource.Vote != testValue+testValue2 || resource.TotalVotes != 2 {
 		t.Errorf("Received Value not mathing with what was inserted after updating.")
 		t.FailNow()
 
 	}
-	err = datab.Close()
+	err = CastVote(VoteRecord{Annotator: "alice", Key: "MissingKey", Label: "true", Score: testValue}, datab)
+	if err != badger.ErrKeyNotFound {
+		t.Errorf("Voting on a missing Tuple should fail with ErrKeyNotFound")
+	}
+	if CountDBSize(datab) != 1 {
+		t.Errorf("Vote records should not be counted as entries")
+	}
+}
+
+func TestLabels(t *testing.T) {
+	datab := initTestDatabase(t)
+	defer closeTestDatabase(t, datab)
+	err := InsertResource(testKey, datab)
 	if err != nil {
-		t.Errorf("Failed at Closing Database")
+		t.Errorf("Unable to Insert Tuple")
 		t.FailNow()
+	}
+	resource, err := GetResource(testKey, datab)
+	if err != nil || len(resource.Labels) != 0 {
+		t.Errorf("Unvoted Tuple should have an empty tally")
+	}
+	for index, label := range []string{"cat", "dog", "cat", "neither"} {
+		err = CastVote(VoteRecord{Annotator: strconv.Itoa(index), Key: testKey, Label: label}, datab)
+		if err != nil {
+			t.Errorf("Unable to Vote Label %s", label)
+			t.FailNow()
+		}
+	}
+	resource, err = GetResource(testKey, datab)
+	if err != nil {
+		t.Errorf("Unable to Fetch Label Tally")
+		t.FailNow()
+	}
+	if resource.Labels["cat"] != 2 || resource.Labels["dog"] != 1 || resource.Labels["neither"] != 1 {
+		t.Errorf("Received Tally not matching with what was voted: %v", resource.Labels)
+	}
+	if resource.Winner != "cat" {
+		t.Errorf("Expected cat to be the winning label, got %s", resource.Winner)
+	}
+	_, err = RetractVote(testKey, "0", datab)
+	if err != nil {
+		t.Errorf("Unable to Undo Label vote")
+	}
+	resource, _ = GetResource(testKey, datab)
+	if resource.Winner != "" {
+		t.Errorf("Tied Tally should have no winner, got %s", resource.Winner)
+	}
+	list, err := GetCurrentVotes(datab)
+	if err != nil || len(list) != 1 || list[0].Labels["dog"] != 1 {
+		t.Errorf("Unable to list current Label tallies")
+	}
+}
 
+func TestVoteRecords(t *testing.T) {
+	datab := initTestDatabase(t)
+	defer closeTestDatabase(t, datab)
+	err := InsertResource(testKey, datab)
+	if err != nil {
+		t.Errorf("Unable to Insert Tuple")
+		t.FailNow()
 	}
-	err = os.RemoveAll(dbPath)
+	err = CastVote(VoteRecord{Annotator: "alice", Key: testKey, Label: "true", Score: 1, Timestamp: time.Now()}, datab)
 	if err != nil {
-		log.Printf("Unable to clean Test Database Aftere test. Check for permissions, and remove foleder '%s' or Future Tests might Fail", dbPath)
+		t.Errorf("Unable to Record Vote")
+		t.FailNow()
+	}
+	err = CastVote(VoteRecord{Annotator: "alice", Key: testKey, Label: "false", Score: -1, Timestamp: time.Now()}, datab)
+	if err != ErrDuplicateVote {
+		t.Errorf("Second vote from the same annotator should fail with ErrDuplicateVote, got %v", err)
+	}
+	err = CastVote(VoteRecord{Annotator: "bob", Key: testKey, Label: "false", Score: -1, Timestamp: time.Now()}, datab)
+	if err != nil {
+		t.Errorf("Unable to Record Vote from a second annotator")
+	}
+	list, err := GetVoteRecords(testKey, datab)
+	if err != nil || len(list) != 2 {
+		t.Errorf("Expected two Vote Records, got %d", len(list))
+	}
+	_, err = RetractVote(testKey, "carol", datab)
+	if err != ErrVoteNotFound {
+		t.Errorf("Retracting a vote that was never cast should fail with ErrVoteNotFound, got %v", err)
+	}
+	record, err := RetractVote(testKey, "alice", datab)
+	if err != nil || record.Label != "true" {
+		t.Errorf("Unable to Retract own Vote")
+	}
+	resource, _ := GetResource(testKey, datab)
+	if resource.Vote != -1 || resource.TotalVotes != 1 {
+		t.Errorf("Retracted vote was not undone on the Tuple: %+v", resource)
+	}
+	err = CastVote(VoteRecord{Annotator: "alice", Key: testKey, Label: "false", Score: -1, Timestamp: time.Now()}, datab)
+	if err != nil {
+		t.Errorf("Annotator should be able to vote again after retracting")
+	}
+}
+
+func TestIterateResources(t *testing.T) {
+	datab := initTestDatabase(t)
+	defer closeTestDatabase(t, datab)
+	for _, key := range []string{"a", "a/b", "c"} {
+		err := InsertResource(key, datab)
+		if err != nil {
+			t.Errorf("Unable to Insert Tuple")
+			t.FailNow()
+		}
+	}
+	CastVote(VoteRecord{Annotator: "alice", Key: "a", Label: "true", Score: 1, Timestamp: time.Now()}, datab)
+	CastVote(VoteRecord{Annotator: "bob", Key: "a", Label: "false", Score: -1, Timestamp: time.Now()}, datab)
+	CastVote(VoteRecord{Annotator: "alice", Key: "a/b", Label: "true", Score: 1, Timestamp: time.Now()}, datab)
+	var keys []string
+	votes := map[string]int{}
+	err := IterateResources(datab, func(resource Resource, records []VoteRecord) error {
+		keys = append(keys, resource.Key)
+		votes[resource.Key] = len(records)
+		return nil
+	})
+	if err != nil || len(keys) != 3 || keys[0] != "a" || keys[2] != "c" {
+		t.Errorf("Expected every resource in key order, got %v", keys)
+	}
+	if votes["a"] != 2 || votes["a/b"] != 1 || votes["c"] != 0 {
+		t.Errorf("Expected the votes of each resource only, got %v", votes)
+	}
+	err = IterateResources(datab, func(resource Resource, records []VoteRecord) error {
+		return ErrKeyExists
+	})
+	if err != ErrKeyExists {
+		t.Errorf("Expected iteration to stop with the callback error")
+	}
+}
+
+func TestDuplicates(t *testing.T) {
+	datab := initTestDatabase(t)
+	defer closeTestDatabase(t, datab)
+	canonical, err := InsertFile("a/cat.jpg", "aaaa", datab)
+	if err != nil || canonical != "a/cat.jpg" {
+		t.Errorf("Unable to Insert File")
+		t.FailNow()
+	}
+	canonical, err = InsertFile("b/cat.jpg", "aaaa", datab)
+	if err != ErrDuplicateContent || canonical != "a/cat.jpg" {
+		t.Errorf("Expected the same content to be recorded as a duplicate, got %s %v", canonical, err)
+	}
+	InsertFile("b/cat.jpg", "aaaa", datab)
+	InsertFile("c/cat.jpg", "aaaa", datab)
+	if _, err := InsertFile("a/cat.jpg", "aaaa", datab); err != ErrKeyExists {
+		t.Errorf("Inserting the same file twice should fail with ErrKeyExists, got %v", err)
+	}
+	InsertFile("dog.jpg", "bbbb", datab)
+	if _, err := GetResource("b/cat.jpg", datab); err != badger.ErrKeyNotFound {
+		t.Errorf("Duplicates should not be stored as resources")
+	}
+	if CountDBSize(datab) != 2 {
+		t.Errorf("Expected two resources, got %d", CountDBSize(datab))
+	}
+	groups, err := GetDuplicates(datab)
+	if err != nil || len(groups) != 1 || groups[0].Canonical != "a/cat.jpg" || groups[0].Hash != "aaaa" || len(groups[0].Duplicates) != 2 {
+		t.Errorf("Unexpected duplicate groups: %+v", groups)
+	}
+	InsertResource("legacy.jpg", datab)
+	if _, err := InsertFile("legacy.jpg", "cccc", datab); err != ErrKeyExists {
+		t.Errorf("Existing resources should fail with ErrKeyExists")
+	}
+	resource, _ := GetResource("legacy.jpg", datab)
+	if resource.Hash != "cccc" {
+		t.Errorf("Existing resources without a hash should get one recorded")
+	}
+	err = SetPerceptualHash("legacy.jpg", "00000000000000ff", datab)
+	resource, _ = GetResource("legacy.jpg", datab)
+	if err != nil || resource.PerceptualHash != "00000000000000ff" {
+		t.Errorf("Unable to record the perceptual hash")
+	}
+}
+
+func TestRenameResource(t *testing.T) {
+	datab := initTestDatabase(t)
+	defer closeTestDatabase(t, datab)
+	InsertFile("old.jpg", "aaaa", datab)
+	InsertFile("copy.jpg", "aaaa", datab)
+	InsertFile("other.jpg", "bbbb", datab)
+	CastVote(VoteRecord{Annotator: "alice", Key: "old.jpg", Label: "true", Score: 1, Timestamp: time.Now()}, datab)
+	SkipResource(SkipRecord{Annotator: "bob", Key: "old.jpg", Reason: "unclear", Timestamp: time.Now()}, datab)
+	err := SetOrphaned("old.jpg", true, datab)
+	if err != nil {
+		t.Errorf("Unable to mark resource as orphaned")
+	}
+	if key, _ := GetSortedKey(datab, ""); key == "old.jpg" {
+		t.Errorf("Orphaned resources should not be scheduled")
+	}
+	if err := RenameResource("old.jpg", "other.jpg", datab); err != ErrKeyExists {
+		t.Errorf("Renaming over another resource should fail with ErrKeyExists, got %v", err)
+	}
+	err = RenameResource("old.jpg", "copy.jpg", datab)
+	if err != nil {
+		t.Errorf("Unable to rename resource: %v", err)
+		t.FailNow()
+	}
+	if _, err := GetResource("old.jpg", datab); err != badger.ErrKeyNotFound {
+		t.Errorf("Renamed resource should not be stored under its old key")
+	}
+	resource, _ := GetResource("copy.jpg", datab)
+	if resource.Vote != 1 || resource.Skips["unclear"] != 1 || resource.Orphaned || len(resource.Duplicates) != 0 {
+		t.Errorf("Unexpected renamed resource: %+v", resource)
+	}
+	records, _ := GetVoteRecords("copy.jpg", datab)
+	if len(records) != 1 || records[0].Key != "copy.jpg" {
+		t.Errorf("Expected the vote records to follow the resource, got %+v", records)
+	}
+	if _, err := RetractVote("copy.jpg", "alice", datab); err != nil {
+		t.Errorf("Expected moved votes to be retractable")
+	}
+	if err := SkipResource(SkipRecord{Annotator: "bob", Key: "copy.jpg", Reason: "unclear"}, datab); err != ErrDuplicateSkip {
+		t.Errorf("Expected the skip records to follow the resource")
+	}
+	if canonical, _ := InsertFile("third.jpg", "aaaa", datab); canonical != "copy.jpg" {
+		t.Errorf("Expected the content hash to point to the new key, got %s", canonical)
+	}
+	RemoveDuplicate("copy.jpg", "third.jpg", datab)
+	resource, _ = GetResource("copy.jpg", datab)
+	if len(resource.Duplicates) != 0 {
+		t.Errorf("Unable to remove duplicate")
+	}
+}
+
+func TestConcurrentVotes(t *testing.T) {
+	const (
+		voters = 1000
+		keys   = 5
+	)
+	datab := initTestDatabase(t)
+	defer closeTestDatabase(t, datab)
+	for k := 0; k < keys; k++ {
+		err := InsertResource(testKey+strconv.Itoa(k), datab)
+		if err != nil {
+			t.Errorf("Unable to Insert Tuple")
+			t.FailNow()
+		}
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < voters; i++ {
+		for k := 0; k < keys; k++ {
+			wg.Add(1)
+			go func(i int, key string) {
+				defer wg.Done()
+				record := VoteRecord{Annotator: strconv.Itoa(i), Key: key, Label: "true", Score: 1}
+				if i%4 == 0 {
+					record.Label = "false"
+					record.Score = -1
+				}
+				err := CastVote(record, datab)
+				if err != nil {
+					t.Errorf("Unable to Vote concurrently: %v", err)
+				}
+				// every tenth annotator changes their mind, retracting concurrently with other votes
+				if i%10 == 0 {
+					_, err = RetractVote(key, record.Annotator, datab)
+					if err != nil {
+						t.Errorf("Unable to Retract concurrently: %v", err)
+					}
+				}
+			}(i, testKey+strconv.Itoa(k))
+		}
+	}
+	wg.Wait()
+	var total, positive, negative int
+	for i := 0; i < voters; i++ {
+		if i%10 == 0 {
+			continue
+		}
+		total++
+		if i%4 == 0 {
+			negative++
+		} else {
+			positive++
+		}
+	}
+	list, err := GetCurrentVotes(datab)
+	if err != nil || len(list) != keys {
+		t.Errorf("Unable to list Tuples")
+		t.FailNow()
+	}
+	for _, resource := range list {
+		if resource.TotalVotes != total || resource.Vote != positive-negative {
+			t.Errorf("Lost concurrent updates on %s: expected %d votes scoring %d, got %d votes scoring %d", resource.Key, total, positive-negative, resource.TotalVotes, resource.Vote)
+		}
+		if resource.Labels["true"] != positive || resource.Labels["false"] != negative {
+			t.Errorf("Lost concurrent label updates on %s: %v", resource.Key, resource.Labels)
+		}
+		records, err := GetVoteRecords(resource.Key, datab)
+		if err != nil || len(records) != total {
+			t.Errorf("Expected %d Vote Records on %s, got %d", total, resource.Key, len(records))
+		}
+	}
+}
+
+func TestSchedulingQueue(t *testing.T) {
+	datab := initTestDatabase(t)
+	defer closeTestDatabase(t, datab)
+	_, err := GetSortedKey(datab, "")
+	if err != badger.ErrKeyNotFound {
+		t.Errorf("Empty database should have no key to schedule")
+	}
+	for _, key := range []string{"a", "b", "c"} {
+		err := InsertResource(key, datab)
+		if err != nil {
+			t.Errorf("Unable to Insert Tuple")
+			t.FailNow()
+		}
+	}
+	votes := map[string]int{"a": 2, "b": 0, "c": 1}
+	for key, amount := range votes {
+		for i := 0; i < amount; i++ {
+			err := CastVote(VoteRecord{Annotator: strconv.Itoa(i), Key: key, Label: "true", Score: 1}, datab)
+			if err != nil {
+				t.Errorf("Unable to Vote")
+				t.FailNow()
+			}
+		}
+	}
+	key, err := GetSortedKey(datab, "")
+	if err != nil || key != "b" {
+		t.Errorf("Expected the least voted key b, got %s", key)
+	}
+	key, err = GetNewSortedKey(datab, "b", "")
+	if err != nil || key != "c" {
+		t.Errorf("Expected the second least voted key c, got %s", key)
+	}
+	for _, annotator := range []string{"0", "1"} {
+		_, err = RetractVote("a", annotator, datab)
+		if err != nil {
+			t.Errorf("Unable to Retract Vote")
+		}
+	}
+	key, err = GetSortedKey(datab, "")
+	scanned, _ := scanSortedKey(datab)
+	if err != nil || key != "a" || scanned != key {
+		t.Errorf("Scheduling queue disagrees with a full scan after retracting: got %s, scan returned %s", key, scanned)
+	}
+	// a queue rebuilt from the stored records must match the one kept up to date while voting
+	forgetQueue(datab)
+	key, err = GetNewSortedKey(datab, "a", "")
+	if err != nil || key != "b" {
+		t.Errorf("Rebuilt scheduling queue out of order, got %s", key)
+	}
+}
+
+// answeredScenario checks that annotators are never handed the keys they voted on or skipped, and leaves x with only a to vote on.
+func answeredScenario(t *testing.T, store Store) {
+	for _, key := range []string{"a", "b", "c"} {
+		store.InsertResource(key)
+	}
+	for annotator, key := range map[string]string{"x": "a", "y": "b", "z": "c"} {
+		err := store.CastVote(VoteRecord{Annotator: annotator, Key: key, Label: "true", Score: 1})
+		if err != nil {
+			t.Errorf("Unable to Vote")
+			t.FailNow()
+		}
+	}
+	if key, err := store.GetSortedKey("x"); err != nil || key != "b" {
+		t.Errorf("Expected x to get b instead of the key they voted on, got %s %v", key, err)
+	}
+	store.SkipResource(SkipRecord{Annotator: "x", Key: "b"})
+	if key, err := store.GetNewSortedKey("b", "x"); err != nil || key != "c" {
+		t.Errorf("Expected x to get c after skipping b, got %s %v", key, err)
+	}
+	store.CastVote(VoteRecord{Annotator: "x", Key: "c", Label: "true", Score: 1})
+	if key, err := store.GetSortedKey("x"); err != ErrNotFound {
+		t.Errorf("Expected nothing left for x, got %s %v", key, err)
+	}
+	if key, _ := store.GetSortedKey(""); key != "a" {
+		t.Errorf("Expected anonymous annotators to still get a, got %s", key)
+	}
+	store.RenameResource("c", "d")
+	store.RetractVote("a", "x")
+	if key, err := store.GetSortedKey("x"); err != nil || key != "a" {
+		t.Errorf("Expected x to get a again after retracting their vote, got %s %v", key, err)
+	}
+	if key, err := store.GetNewSortedKey("a", "x"); err != ErrNotFound {
+		t.Errorf("Expected the vote of x to follow the renamed key, got %s %v", key, err)
+	}
+}
+
+func TestAnsweredKeys(t *testing.T) {
+	datab := initTestDatabase(t)
+	answeredScenario(t, NewBadgerStore(datab))
+	// a queue rebuilt from the stored records must remember the answers as well
+	forgetQueue(datab)
+	if key, err := GetNewSortedKey(datab, "", "x"); err != nil || key != "a" {
+		t.Errorf("Expected the rebuilt queue to only hand a to x, got %s %v", key, err)
+	}
+	closeTestDatabase(t, datab)
+	answeredScenario(t, NewMemoryStore())
+	os.Remove(boltPath)
+	defer os.Remove(boltPath)
+	store, err := OpenBolt(boltPath)
+	if err != nil {
+		t.Errorf("Unable to Open bolt Database: %v", err)
+		t.FailNow()
+	}
+	answeredScenario(t, store)
+	store.Close()
+	store, err = OpenBolt(boltPath)
+	if err != nil {
+		t.Errorf("Unable to Open bolt Database: %v", err)
+		t.FailNow()
+	}
+	defer store.Close()
+	if key, err := store.GetNewSortedKey("", "x"); err != nil || key != "a" {
+		t.Errorf("Expected the reopened queue to only hand a to x, got %s %v", key, err)
+	}
+}
+
+func TestPrior(t *testing.T) {
+	datab := initTestDatabase(t)
+	defer closeTestDatabase(t, datab)
+	for _, key := range []string{"a", "b", "c"} {
+		InsertResource(key, datab)
+	}
+	CastVote(VoteRecord{Annotator: "alice", Key: "a", Label: "true", Score: 1}, datab)
+	err := SetPrior("a", map[string]int{"true": 3, "false": 1}, "true", 0, datab)
+	if err != nil {
+		t.Errorf("Unable to set prior: %v", err)
+		t.FailNow()
+	}
+	// seeding again replaces the prior instead of adding to it
+	SetPrior("a", map[string]int{"true": 2, "false": 1}, "true", 0, datab)
+	resource, _ := GetResource("a", datab)
+	if resource.Vote != 2 || resource.TotalVotes != 4 || resource.Labels["true"] != 3 || resource.Labels["false"] != 1 || resource.Prior["true"] != 2 {
+		t.Errorf("Unexpected seeded resource: %+v", resource)
+	}
+	SetPrior("a", nil, "true", 0, datab)
+	resource, _ = GetResource("a", datab)
+	if resource.Vote != 1 || resource.TotalVotes != 1 || resource.Labels["false"] != 0 || resource.Prior != nil {
+		t.Errorf("Expected an empty prior to leave the cast votes only: %+v", resource)
+	}
+	// higher priorities are scheduled first, whatever their amount of votes
+	SetPrior("c", map[string]int{"false": 5}, "true", 2, datab)
+	key, err := GetSortedKey(datab, "")
+	if err != nil || key != "c" {
+		t.Errorf("Expected the prioritized key c, got %s", key)
 	}
+	key, _ = GetNewSortedKey(datab, "c", "")
+	if key != "b" {
+		t.Errorf("Expected the least voted key b after c, got %s", key)
+	}
+	forgetQueue(datab)
+	if key, _ := GetSortedKey(datab, ""); key != "c" {
+		t.Errorf("Rebuilt scheduling queue lost the priority, got %s", key)
+	}
+}
+
+func TestLeases(t *testing.T) {
+	datab := initTestDatabase(t)
+	defer closeTestDatabase(t, datab)
+	defer func(ttl time.Duration) { LeaseTTL = ttl }(LeaseTTL)
+	LeaseTTL = time.Hour
+	for _, key := range []string{"a", "b", "c"} {
+		err := InsertResource(key, datab)
+		if err != nil {
+			t.Errorf("Unable to Insert Tuple")
+			t.FailNow()
+		}
+	}
+	alice, _ := GetSortedKey(datab, "alice")
+	bob, _ := GetSortedKey(datab, "bob")
+	carol, _ := GetSortedKey(datab, "carol")
+	if alice != "a" || bob != "b" || carol != "c" {
+		t.Errorf("Leased keys should not be handed to other annotators, got %s %s %s", alice, bob, carol)
+	}
+	_, err := GetSortedKey(datab, "dave")
+	if err != badger.ErrKeyNotFound {
+		t.Errorf("Every key is leased, dave should not get one")
+	}
+	again, _ := GetSortedKey(datab, "alice")
+	if again != "a" {
+		t.Errorf("Annotators asking again should get their leased key back, got %s", again)
+	}
+	err = CastVote(VoteRecord{Annotator: "alice", Key: "a", Label: "true", Score: 1}, datab)
+	if err != nil {
+		t.Errorf("Unable to Vote")
+	}
+	// a was released by the vote, but bob and carol still hold the unvoted keys
+	dave, _ := GetSortedKey(datab, "dave")
+	if dave != "a" {
+		t.Errorf("Voted key should be released, dave got %s", dave)
+	}
+	// asking for a new key releases the previous one
+	bob, _ = GetNewSortedKey(datab, "b", "bob")
+	if bob != "" {
+		t.Errorf("Every other key is leased, bob should not get one, got %s", bob)
+	}
+	erin, _ := GetSortedKey(datab, "erin")
+	if erin != "b" {
+		t.Errorf("Skipped key should be released, erin got %s", erin)
+	}
+	_, err = GetSortedKey(datab, "frank")
+	if err != badger.ErrKeyNotFound {
+		t.Errorf("Every key is leased, frank should not get one")
+	}
+	queueFor(datab).expire(time.Now().Add(2 * LeaseTTL))
+	_, err = GetSortedKey(datab, "frank")
+	if err != nil {
+		t.Errorf("Expired leases should be released")
+	}
+}
+
+func TestQueueAnswered(t *testing.T) {
+	q := newQueue()
+	for i := 0; i < 50; i++ {
+		q.set(Resource{Key: strconv.Itoa(100 + i), TotalVotes: i % 5})
+	}
+	// alice answered every key with less than two votes, but for the last five keys
+	for i := 0; i < 45; i++ {
+		if i%5 < 2 {
+			q.answer(strconv.Itoa(100+i), "alice")
+		}
+	}
+	before := append(queueHeap(nil), q.heap...)
+	key, ok := q.next("", "", time.Hour)
+	if !ok || key != "100" {
+		t.Errorf("Expected anonymous annotators to get the least voted key, got %s", key)
+	}
+	key, ok = q.next("", "alice", time.Hour)
+	if !ok || key != "145" {
+		t.Errorf("Expected alice to get the least voted key she did not answer, got %s", key)
+	}
+	if len(q.heap) != len(before)-1 {
+		t.Errorf("Expected only the leased key to leave the heap, %d of %d items left", len(q.heap), len(before))
+	}
+	for _, item := range before {
+		if item.key != key && (item.index < 0 || q.heap[item.index] != item) {
+			t.Errorf("Expected passed items to stay in the heap, %s is at %d", item.key, item.index)
+		}
+	}
+	for i := 1; i < len(q.heap); i++ {
+		if q.heap.Less(i, (i-1)/2) {
+			t.Errorf("Expected the heap to stay ordered at %d", i)
+		}
+	}
+}
+
+func TestCompletionPolicy(t *testing.T) {
+	datab := initTestDatabase(t)
+	defer closeTestDatabase(t, datab)
+	defer func(policy Policy) { CompletionPolicy = policy }(CompletionPolicy)
+	CompletionPolicy = Policy{MinVotes: 3, Agreement: 0.75, MaxVotes: 5}
+	for _, key := range []string{"agreed", "ambiguous"} {
+		err := InsertResource(key, datab)
+		if err != nil {
+			t.Errorf("Unable to Insert Tuple")
+			t.FailNow()
+		}
+	}
+	votes := map[string][]string{
+		"agreed":    {"cat", "cat", "cat"},
+		"ambiguous": {"cat", "dog", "cat", "dog"},
+	}
+	for key, labels := range votes {
+		for i, label := range labels {
+			err := CastVote(VoteRecord{Annotator: strconv.Itoa(i), Key: key, Label: label}, datab)
+			if err != nil {
+				t.Errorf("Unable to Vote")
+				t.FailNow()
+			}
+		}
+	}
+	resource, _ := GetResource("agreed", datab)
+	if !resource.Finalized {
+		t.Errorf("Three agreeing votes should finalize the Tuple")
+	}
+	resource, _ = GetResource("ambiguous", datab)
+	if resource.Finalized {
+		t.Errorf("Tied votes should not finalize the Tuple")
+	}
+	key, _ := GetNewSortedKey(datab, "ambiguous", "")
+	if key != "" {
+		t.Errorf("Finalized Tuples should not be scheduled, got %s", key)
+	}
+	err := CastVote(VoteRecord{Annotator: "4", Key: "ambiguous", Label: "bird"}, datab)
+	if err != nil {
+		t.Errorf("Unable to Vote")
+	}
+	resource, _ = GetResource("ambiguous", datab)
+	if !resource.Finalized {
+		t.Errorf("Reaching MaxVotes should finalize the Tuple")
+	}
+	_, err = GetSortedKey(datab, "")
+	if err != badger.ErrKeyNotFound {
+		t.Errorf("Every Tuple is finalized, none should be scheduled")
+	}
+	_, err = RetractVote("agreed", "0", datab)
+	if err != nil {
+		t.Errorf("Unable to Retract Vote")
+	}
+	key, _ = GetSortedKey(datab, "")
+	if key != "agreed" {
+		t.Errorf("Tuples falling below the policy should be scheduled again, got %s", key)
+	}
+}
+
+func TestSkips(t *testing.T) {
+	datab := initTestDatabase(t)
+	defer closeTestDatabase(t, datab)
+	defer func(policy Policy) { CompletionPolicy = policy }(CompletionPolicy)
+	CompletionPolicy = Policy{MaxSkips: 2}
+	err := InsertResource(testKey, datab)
+	if err != nil {
+		t.Errorf("Unable to Insert Tuple")
+		t.FailNow()
+	}
+	key, _ := GetSortedKey(datab, "alice")
+	err = SkipResource(SkipRecord{Annotator: "alice", Key: key, Reason: "broken"}, datab)
+	if err != nil {
+		t.Errorf("Unable to Skip Tuple")
+	}
+	err = SkipResource(SkipRecord{Annotator: "alice", Key: key, Reason: "unclear"}, datab)
+	if err != ErrDuplicateSkip {
+		t.Errorf("Skipping twice should fail with ErrDuplicateSkip, got %v", err)
+	}
+	err = SkipResource(SkipRecord{Annotator: "bob", Key: key, Reason: "blurry"}, datab)
+	if err != ErrUnknownReason {
+		t.Errorf("Skipping with an unknown reason should fail with ErrUnknownReason, got %v", err)
+	}
+	resource, _ := GetResource(testKey, datab)
+	if resource.TotalVotes != 0 || resource.Vote != 0 || resource.Skips["broken"] != 1 || resource.Flagged {
+		t.Errorf("Skip should be recorded without changing the score: %+v", resource)
+	}
+	key, _ = GetSortedKey(datab, "bob")
+	if key != testKey {
+		t.Errorf("Skipping should release the lease, bob got %s", key)
+	}
+	err = SkipResource(SkipRecord{Annotator: "bob", Key: key}, datab)
+	if err != nil {
+		t.Errorf("Unable to Skip Tuple without a reason")
+	}
+	resource, _ = GetResource(testKey, datab)
+	if resource.Skips["unspecified"] != 1 || !resource.Flagged {
+		t.Errorf("Tuple skipped MaxSkips times should be flagged: %+v", resource)
+	}
+	_, err = GetSortedKey(datab, "carol")
+	if err != badger.ErrKeyNotFound {
+		t.Errorf("Flagged Tuples should not be scheduled")
+	}
+}
+
+// scanSortedKey is the scheduling approach used before the queue: read every resource and sort them by their amount of votes.
+// It is kept as a reference for TestSchedulingQueue and the benchmarks.
+func scanSortedKey(dbpointer *badger.DB) (topKey string, err error) {
+	var list []VoteInt
+	err = dbpointer.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchSize = 70000
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		prefix := []byte(resourcePrefix)
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			val, err := it.Item().Value()
+			if err != nil {
+				return err
+			}
+			var resource Resource
+			err = json.Unmarshal(val, &resource)
+			if err != nil {
+				return err
+			}
+			list = append(list, VoteInt{resource.Key, resource.TotalVotes})
+		}
+		return nil
+	})
+	sort.SliceStable(list, func(i, j int) bool {
+		return list[i].Vote < list[j].Vote
+	})
+	if len(list) > 0 {
+		topKey = list[0].Key
+	}
+	return
+}
+
+// benchmarkSortedKey fills a test database with size resources, where every resource but the last one received a vote,
+// and measures how long next takes to find the unvoted one.
+func benchmarkSortedKey(b *testing.B, size int, next func(*badger.DB) (string, error)) {
+	os.RemoveAll(dbPath)
+	datab, err := Init(dbPath)
+	if err != nil {
+		b.Fatal("Unable to Init Database")
+	}
+	defer os.RemoveAll(dbPath)
+	defer Close(datab)
+	for i := 0; i < size; i++ {
+		key := strconv.Itoa(i)
+		err = InsertResource(key, datab)
+		if err == nil && i < size-1 {
+			err = CastVote(VoteRecord{Annotator: "bench", Key: key, Label: "true", Score: 1}, datab)
+		}
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		key, err := next(datab)
+		if err != nil || key != strconv.Itoa(size-1) {
+			b.Fatalf("Expected the unvoted key %d, got %s", size-1, key)
+		}
+	}
+}
+
+// queueSortedKey schedules anonymously, so the benchmarks do not lease the unvoted key away.
+func queueSortedKey(dbpointer *badger.DB) (string, error) { return GetSortedKey(dbpointer, "") }
+
+func BenchmarkQueueSortedKey1000(b *testing.B)  { benchmarkSortedKey(b, 1000, queueSortedKey) }
+func BenchmarkQueueSortedKey10000(b *testing.B) { benchmarkSortedKey(b, 10000, queueSortedKey) }
+func BenchmarkScanSortedKey1000(b *testing.B)   { benchmarkSortedKey(b, 1000, scanSortedKey) }
+func BenchmarkScanSortedKey10000(b *testing.B)  { benchmarkSortedKey(b, 10000, scanSortedKey) }
+
+// storeScenario runs the same votes, skips, duplicates and renames against a Store, so every implementation behaves alike.
+func storeScenario(t *testing.T, store Store) {
+	for _, key := range []string{"a.jpg", "b.jpg"} {
+		if _, err := store.InsertFile(key, "hash-"+key); err != nil {
+			t.Errorf("Unable to Insert File %s: %v", key, err)
+			t.FailNow()
+		}
+	}
+	if canonical, err := store.InsertFile("copy.jpg", "hash-a.jpg"); err != ErrDuplicateContent || canonical != "a.jpg" {
+		t.Errorf("Expected copy.jpg to be a duplicate of a.jpg, got %s %v", canonical, err)
+	}
+	if _, err := store.InsertFile("a.jpg", "hash-a.jpg"); err != ErrKeyExists {
+		t.Errorf("Expected ErrKeyExists, got %v", err)
+	}
+	if err := store.InsertResource("c.jpg"); err != nil || store.InsertResource("c.jpg") != ErrKeyExists {
+		t.Errorf("Unable to Insert Resource")
+	}
+	if _, err := store.GetResource("missing.jpg"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+	store.CastVote(VoteRecord{Annotator: "alice", Key: "a.jpg", Label: "true", Score: 1})
+	store.CastVote(VoteRecord{Annotator: "bob", Key: "a.jpg", Label: "false", Score: -1})
+	store.CastVote(VoteRecord{Annotator: "alice", Key: "b.jpg", Label: "true", Score: 1})
+	if err := store.CastVote(VoteRecord{Annotator: "alice", Key: "a.jpg", Label: "true", Score: 1}); err != ErrDuplicateVote {
+		t.Errorf("Expected ErrDuplicateVote, got %v", err)
+	}
+	if err := store.CastVote(VoteRecord{Annotator: "alice", Key: "missing.jpg", Label: "true", Score: 1}); err != ErrNotFound {
+		t.Errorf("Expected votes on missing keys to fail with ErrNotFound, got %v", err)
+	}
+	if _, err := store.RetractVote("b.jpg", "bob"); err != ErrVoteNotFound {
+		t.Errorf("Expected ErrVoteNotFound, got %v", err)
+	}
+	if record, err := store.RetractVote("b.jpg", "alice"); err != nil || record.Label != "true" {
+		t.Errorf("Unable to Retract Vote: %v", err)
+	}
+	if err := store.SkipResource(SkipRecord{Annotator: "carol", Key: "c.jpg", Reason: "broken"}); err != nil {
+		t.Errorf("Unable to Skip: %v", err)
+	}
+	if store.SkipResource(SkipRecord{Annotator: "carol", Key: "c.jpg"}) != ErrDuplicateSkip || store.SkipResource(SkipRecord{Annotator: "dave", Key: "c.jpg", Reason: "boring"}) != ErrUnknownReason {
+		t.Errorf("Expected duplicate skips and unknown reasons to be refused")
+	}
+	resource, _ := store.GetResource("a.jpg")
+	if resource.Vote != 0 || resource.TotalVotes != 2 || resource.Labels["true"] != 1 || len(resource.Duplicates) != 1 {
+		t.Errorf("Unexpected resource: %+v", resource)
+	}
+	if key, err := store.GetSortedKey(""); err != nil || key != "b.jpg" {
+		t.Errorf("Expected the least voted key b.jpg, got %s %v", key, err)
+	}
+	if key, _ := store.GetNewSortedKey("b.jpg", ""); key != "c.jpg" {
+		t.Errorf("Expected the next least voted key c.jpg, got %s", key)
+	}
+	store.SetPrior("c.jpg", map[string]int{"false": 2}, "true", 1)
+	store.SetPerceptualHash("c.jpg", "00ff00ff00ff00ff")
+	store.SetMetadata("c.jpg", Metadata{Width: 4, Height: 2})
+	resource, _ = store.GetResource("c.jpg")
+	if resource.Vote != -2 || resource.Priority != 1 || resource.PerceptualHash == "" || resource.Metadata.Aspect() != 2 {
+		t.Errorf("Unexpected updated resource: %+v", resource)
+	}
+	if key, _ := store.GetSortedKey(""); key != "c.jpg" {
+		t.Errorf("Expected the prioritized key c.jpg, got %s", key)
+	}
+	if err := store.RenameResource("a.jpg", "copy.jpg"); err != nil {
+		t.Errorf("Unable to rename: %v", err)
+	}
+	records, _ := store.GetVoteRecords("copy.jpg")
+	if len(records) != 2 || records[0].Annotator != "alice" || records[0].Key != "copy.jpg" {
+		t.Errorf("Expected the votes to follow the renamed resource, got %+v", records)
+	}
+	if canonical, _ := store.InsertFile("third.jpg", "hash-a.jpg"); canonical != "copy.jpg" {
+		t.Errorf("Expected the hash index to follow the renamed resource, got %s", canonical)
+	}
+	duplicates, err := store.ReplaceContent("copy.jpg", "hash-new.jpg")
+	if err != nil || len(duplicates) != 1 || duplicates[0] != "third.jpg" {
+		t.Errorf("Expected the duplicates of the previous content to be given back, got %v %v", duplicates, err)
+	}
+	if canonical, err := store.InsertFile("third.jpg", "hash-a.jpg"); err != nil || canonical != "third.jpg" {
+		t.Errorf("Expected the previous content to be free again, got %s %v", canonical, err)
+	}
+	if canonical, err := store.InsertFile("fourth.jpg", "hash-new.jpg"); err != ErrDuplicateContent || canonical != "copy.jpg" {
+		t.Errorf("Expected the new content to be indexed under its key, got %s %v", canonical, err)
+	}
+	if duplicates, err := store.ReplaceContent("copy.jpg", "hash-new.jpg"); err != nil || len(duplicates) != 0 {
+		t.Errorf("Expected the same content to change nothing, got %v %v", duplicates, err)
+	}
+	resource, _ = store.GetResource("copy.jpg")
+	if resource.Hash != "hash-new.jpg" || resource.TotalVotes != 2 || len(resource.Duplicates) != 1 {
+		t.Errorf("Expected the replaced resource to keep its votes and its new duplicates: %+v", resource)
+	}
+	store.RemoveDuplicate("copy.jpg", "fourth.jpg")
+	store.SetOrphaned("third.jpg", true)
+	store.SetOrphaned("b.jpg", true)
+	if key, _ := store.GetNewSortedKey("c.jpg", ""); key != "copy.jpg" {
+		t.Errorf("Orphaned resources should not be scheduled, got %s", key)
+	}
+	groups, _ := store.GetDuplicates()
+	if len(groups) != 0 {
+		t.Errorf("Expected no duplicates left, got %+v", groups)
+	}
+	var keys []string
+	store.IterateResources(func(resource Resource, votes []VoteRecord) error {
+		keys = append(keys, resource.Key+":"+strconv.Itoa(len(votes)))
+		return nil
+	})
+	list, _ := store.GetCurrentVotes()
+	if len(keys) != 4 || keys[0] != "b.jpg:0" || keys[2] != "copy.jpg:2" || len(list) != 4 || store.CountDBSize() != 4 {
+		t.Errorf("Unexpected resources: %v", keys)
+	}
+}
+
+func TestStores(t *testing.T) {
+	datab := initTestDatabase(t)
+	store := NewBadgerStore(datab)
+	storeScenario(t, store)
+	store.Close()
+	os.RemoveAll(dbPath)
+	storeScenario(t, NewMemoryStore())
+	os.Remove(boltPath)
+	store, err := OpenEngine(EngineBolt, boltPath)
+	if err != nil {
+		t.Errorf("Unable to Open bolt Database: %v", err)
+		t.FailNow()
+	}
+	storeScenario(t, store)
+	store.Close()
+	os.Remove(boltPath)
+	if _, err := OpenEngine("sqlite", boltPath); err != ErrUnknownEngine {
+		t.Errorf("Expected ErrUnknownEngine, got %v", err)
+	}
+}
+
+// writeLegacy stores varint values under bare keys, like the legacy score and count databases.
+func writeLegacy(t *testing.T, path string, values map[string]int) {
+	dbpointer, err := Init(path)
+	if err != nil {
+		t.Errorf("Unable to Init legacy Database")
+		t.FailNow()
+	}
+	defer dbpointer.Close()
+	err = dbpointer.Update(func(txn *badger.Txn) error {
+		for key, value := range values {
+			buffer := make([]byte, binary.MaxVarintLen64)
+			err := txn.Set([]byte(key), buffer[:binary.PutVarint(buffer, int64(value))])
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Errorf("Unable to write legacy Database")
+		t.FailNow()
+	}
+}
+
+func TestUpgradeLegacy(t *testing.T) {
+	os.RemoveAll(dbPath)
+	os.RemoveAll(dbPath + legacyCountSuffix)
+	defer os.RemoveAll(dbPath)
+	defer os.RemoveAll(dbPath + legacyCountSuffix)
+	writeLegacy(t, dbPath, map[string]int{"./static/a.jpg": 2, "./static/b.jpg": -1, "./static/c.jpg": 0})
+	writeLegacy(t, dbPath+legacyCountSuffix, map[string]int{"./static/a.jpg": 4, "./static/b.jpg": 1})
+	if _, err := Open(dbPath); err != ErrLegacyDatabase {
+		t.Errorf("Expected ErrLegacyDatabase, got %v", err)
+		t.FailNow()
+	}
+	resources, err := UpgradeLegacy(dbPath)
+	if err != nil || resources != 3 {
+		t.Errorf("Expected 3 converted entries, got %d %v", resources, err)
+	}
+	if _, err := os.Stat(dbPath + legacyCountSuffix); !os.IsNotExist(err) {
+		t.Errorf("Expected the count Database to be removed")
+	}
+	if resources, err := UpgradeLegacy(dbPath); err != nil || resources != 0 {
+		t.Errorf("Expected a converted Database to be left as it is, got %d %v", resources, err)
+	}
+	store, err := Open(dbPath)
+	if err != nil {
+		t.Errorf("Unable to Open converted Database: %v", err)
+		t.FailNow()
+	}
+	defer store.Close()
+	a, _ := store.GetResource("./static/a.jpg")
+	b, _ := store.GetResource("./static/b.jpg")
+	if a.Vote != 2 || a.TotalVotes != 4 || a.Labels["true"] != 3 || a.Labels["false"] != 1 || b.Vote != -1 || b.TotalVotes != 1 || b.Winner != "false" {
+		t.Errorf("Unexpected converted resources: %+v %+v", a, b)
+	}
+	if store.CountDBSize() != 3 {
+		t.Errorf("Expected 3 resources, got %d", store.CountDBSize())
+	}
+	if key, _ := store.GetSortedKey(""); key != "./static/c.jpg" {
+		t.Errorf("Expected the unvoted key to be scheduled first, got %s", key)
+	}
+}
+
+func TestMigrateBadger(t *testing.T) {
+	datab := initTestDatabase(t)
+	InsertFile("a.jpg", "hash-a", datab)
+	InsertFile("copy.jpg", "hash-a", datab)
+	InsertResource("b.jpg", datab)
+	CastVote(VoteRecord{Annotator: "alice", Key: "a.jpg", Label: "true", Score: 1}, datab)
+	SkipResource(SkipRecord{Annotator: "bob", Key: "b.jpg", Reason: "broken"}, datab)
+	datab.Update(func(txn *badger.Txn) error { return txn.Set([]byte("./static/stray.jpg"), []byte{2}) })
+	Close(datab)
+	defer os.RemoveAll(dbPath)
+	os.Remove(boltPath)
+	defer os.Remove(boltPath)
+
+	resources, err := MigrateBadger(dbPath, boltPath)
+	if err != nil || resources != 2 {
+		t.Errorf("Expected 2 migrated resources, got %d %v", resources, err)
+	}
+	if _, err := MigrateBadger(dbPath, boltPath); err != ErrNotEmpty {
+		t.Errorf("Expected ErrNotEmpty when migrating twice, got %v", err)
+	}
+	if _, err := MigrateBadger("./missing.db", "./missing.bolt"); err == nil {
+		t.Errorf("Expected a missing Badger Database to fail")
+	}
+	store, err := OpenBolt(boltPath)
+	if err != nil {
+		t.Errorf("Unable to Open bolt Database: %v", err)
+		t.FailNow()
+	}
+	defer store.Close()
+	resource, _ := store.GetResource("a.jpg")
+	records, _ := store.GetVoteRecords("a.jpg")
+	if resource.Vote != 1 || len(resource.Duplicates) != 1 || len(records) != 1 || records[0].Annotator != "alice" {
+		t.Errorf("Unexpected migrated resource: %+v %+v", resource, records)
+	}
+	if err := store.CastVote(VoteRecord{Annotator: "alice", Key: "a.jpg", Label: "true", Score: 1}); err != ErrDuplicateVote {
+		t.Errorf("Expected the migrated votes to be kept, got %v", err)
+	}
+	if err := store.SkipResource(SkipRecord{Annotator: "bob", Key: "b.jpg"}); err != ErrDuplicateSkip {
+		t.Errorf("Expected the migrated skips to be kept, got %v", err)
+	}
+	if canonical, err := store.InsertFile("third.jpg", "hash-a"); err != ErrDuplicateContent || canonical != "a.jpg" {
+		t.Errorf("Expected the migrated hash index to be kept, got %s %v", canonical, err)
+	}
+	if key, _ := store.GetSortedKey(""); key != "b.jpg" {
+		t.Errorf("Expected the migrated queue to start with b.jpg, got %s", key)
+	}
+	store.(*boltStore).db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket(boltBucket).Get([]byte("./static/stray.jpg")) != nil {
+			t.Errorf("Expected keys without a known prefix to be left behind")
+		}
+		return nil
+	})
 }
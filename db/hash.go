@@ -0,0 +1,146 @@
+package db
+
+import (
+	"errors"
+	"sort"
+
+	"github.com/dgraph-io/badger"
+)
+
+// ErrDuplicateContent is returned when inserting a file whose content is already stored under another key.
+var ErrDuplicateContent = errors.New("Content already stored under another key")
+
+// errHashMoved is returned inside InsertFile transactions when the hash index changed since it was read, so the insert is retried.
+var errHashMoved = errors.New("Hash index changed")
+
+// DuplicateGroup lists the paths holding the same content. Canonical is the only one stored as a resource.
+type DuplicateGroup struct {
+	Hash       string   `json:"Hash"`
+	Canonical  string   `json:"Canonical"`
+	Duplicates []string `json:"Duplicates"`
+}
+
+// hashKey builds the storage key of the index entry of a content hash.
+func hashKey(hash string) []byte {
+	return []byte(hashPrefix + hash)
+}
+
+// getCanonical returns the key of the resource holding the content hash, or an empty string if there is none.
+func getCanonical(txn *badger.Txn, hash string) (string, error) {
+	item, err := txn.Get(hashKey(hash))
+	if err == badger.ErrKeyNotFound {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	val, err := item.Value()
+	return string(val), err
+}
+
+// InsertFile creates an empty record for key holding content with the provided hash, and returns the canonical key of that content.
+// When the content is already stored under another key, key is added to its Duplicates instead and ErrDuplicateContent is returned.
+// Keys already in the database fail with ErrKeyExists, getting their hash recorded if they did not have one.
+func InsertFile(key string, hash string, dbpointer *badger.DB) (canonical string, err error) {
+	for {
+		err = dbpointer.View(func(txn *badger.Txn) (err error) {
+			canonical, err = getCanonical(txn, hash)
+			return
+		})
+		if err != nil {
+			return
+		}
+		if canonical == "" || canonical == key {
+			canonical = key
+			existed := false
+			err = update(dbpointer, key, func(txn *badger.Txn) (Resource, error) {
+				current, err := getCanonical(txn, hash)
+				if err != nil {
+					return Resource{}, err
+				} else if current != "" && current != key {
+					return Resource{}, errHashMoved
+				}
+				resource, err := getResource(txn, key)
+				if err == nil && resource.Hash != "" {
+					return Resource{}, ErrKeyExists
+				}
+				existed = err == nil
+				if err == badger.ErrKeyNotFound {
+					resource = Resource{Key: key, Labels: map[string]int{}}
+				} else if err != nil {
+					return Resource{}, err
+				}
+				resource.Hash = hash
+				err = txn.Set(hashKey(hash), []byte(key))
+				if err != nil {
+					return Resource{}, err
+				}
+				return setResource(txn, resource)
+			})
+			if err == nil && existed {
+				err = ErrKeyExists
+			}
+		} else {
+			err = update(dbpointer, canonical, func(txn *badger.Txn) (Resource, error) {
+				current, err := getCanonical(txn, hash)
+				if err != nil {
+					return Resource{}, err
+				} else if current != canonical {
+					return Resource{}, errHashMoved
+				}
+				resource, err := getResource(txn, canonical)
+				if err != nil {
+					return Resource{}, err
+				}
+				for _, duplicate := range resource.Duplicates {
+					if duplicate == key {
+						return resource, nil
+					}
+				}
+				resource.Duplicates = append(resource.Duplicates, key)
+				sort.Strings(resource.Duplicates)
+				return setResource(txn, resource)
+			})
+			if err == nil {
+				err = ErrDuplicateContent
+			}
+		}
+		if err != errHashMoved {
+			return
+		}
+	}
+}
+
+// GetDuplicates returns every group of paths holding the same content, sorted by canonical key.
+func GetDuplicates(dbpointer *badger.DB) (groups []DuplicateGroup, err error) {
+	err = IterateResources(dbpointer, func(resource Resource, votes []VoteRecord) error {
+		if len(resource.Duplicates) > 0 {
+			groups = append(groups, DuplicateGroup{Hash: resource.Hash, Canonical: resource.Key, Duplicates: resource.Duplicates})
+		}
+		return nil
+	})
+	return
+}
+
+// SetPerceptualHash records the perceptual hash of the picture stored under key.
+func SetPerceptualHash(key string, hash string, dbpointer *badger.DB) error {
+	return update(dbpointer, key, func(txn *badger.Txn) (Resource, error) {
+		resource, err := getResource(txn, key)
+		if err != nil {
+			return resource, err
+		}
+		resource.PerceptualHash = hash
+		return setResource(txn, resource)
+	})
+}
+
+// SetMetadata records the metadata of the file stored under key.
+func SetMetadata(key string, metadata Metadata, dbpointer *badger.DB) error {
+	return update(dbpointer, key, func(txn *badger.Txn) (Resource, error) {
+		resource, err := getResource(txn, key)
+		if err != nil {
+			return resource, err
+		}
+		resource.Metadata = &metadata
+		return setResource(txn, resource)
+	})
+}
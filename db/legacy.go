@@ -0,0 +1,164 @@
+package db
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+
+	"github.com/dgraph-io/badger"
+)
+
+// ErrLegacyDatabase is returned by Open for databases written by versions storing a bare score per key, next to a .count database.
+// They are converted by UpgradeLegacy.
+var ErrLegacyDatabase = errors.New("Database uses the legacy score format, and must be converted with -upgrade")
+
+// legacyCountSuffix names the database that held the amount of votes of every key, next to the legacy score database.
+const legacyCountSuffix = ".count"
+
+// legacyKey reports whether a stored key was written by the legacy format, where keys were bare paths.
+func legacyKey(key []byte) bool {
+	for _, prefix := range []string{resourcePrefix, recordPrefix, skipPrefix, hashPrefix} {
+		if bytes.HasPrefix(key, []byte(prefix)) {
+			return false
+		}
+	}
+	return true
+}
+
+// hasLegacyKeys reports whether the database holds any key of the legacy format.
+func hasLegacyKeys(dbpointer *badger.DB) (found bool, err error) {
+	err = dbpointer.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			if legacyKey(it.Item().Key()) {
+				found = true
+				return nil
+			}
+		}
+		return nil
+	})
+	return
+}
+
+// readLegacyScores reads the varint values stored under the legacy keys of a database.
+func readLegacyScores(dbpointer *badger.DB) (scores map[string]int, err error) {
+	scores = map[string]int{}
+	err = dbpointer.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			if !legacyKey(it.Item().Key()) {
+				continue
+			}
+			val, err := it.Item().Value()
+			if err != nil {
+				return err
+			}
+			score, n := binary.Varint(val)
+			if n <= 0 {
+				return errors.New("Invalid legacy value for key " + string(it.Item().Key()))
+			}
+			scores[string(it.Item().Key())] = int(score)
+		}
+		return nil
+	})
+	return
+}
+
+// legacyPrior returns the label counts behind a legacy score, the amount of "true" votes minus the amount of "false" ones,
+// and its amount of votes. Both were updated separately, so counts that do not add up are rounded to the closest valid ones.
+func legacyPrior(score int, votes int) map[string]int {
+	if votes < score {
+		votes = score
+	}
+	if votes < -score {
+		votes = -score
+	}
+	positive := (votes + score) / 2
+	prior := map[string]int{}
+	if positive > 0 {
+		prior["true"] = positive
+	}
+	if votes-positive > 0 {
+		prior["false"] = votes - positive
+	}
+	return prior
+}
+
+// UpgradeLegacy converts the legacy Badger database at databasePath in place, returning the amount of keys converted.
+// Every key becomes a resource holding its "true" and "false" votes as prior counts, since the annotators who cast them were not recorded,
+// and the .count database next to it is removed once every key is converted. Databases without legacy keys are left as they are.
+func UpgradeLegacy(databasePath string) (resources int, err error) {
+	if _, err = os.Stat(databasePath); err != nil {
+		return
+	}
+	dbpointer, err := Init(databasePath)
+	if err != nil {
+		return
+	}
+	defer Close(dbpointer)
+	scores, err := readLegacyScores(dbpointer)
+	if err != nil || len(scores) == 0 {
+		return
+	}
+	counts := map[string]int{}
+	countPath := databasePath + legacyCountSuffix
+	if _, statErr := os.Stat(countPath); statErr == nil {
+		countpointer, err := Init(countPath)
+		if err != nil {
+			return 0, err
+		}
+		counts, err = readLegacyScores(countpointer)
+		countpointer.Close()
+		if err != nil {
+			return 0, err
+		}
+	}
+	keys := make([]string, 0, len(scores))
+	for key := range scores {
+		keys = append(keys, key)
+	}
+	// keys are converted in batches, so a large database does not end up in a single transaction
+	const batchSize = 500
+	for start := 0; start < len(keys); start += batchSize {
+		end := start + batchSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+		err = dbpointer.Update(func(txn *badger.Txn) error {
+			for _, key := range keys[start:end] {
+				resource, err := getResource(txn, key)
+				if err == badger.ErrKeyNotFound {
+					resource = Resource{Key: key, Labels: map[string]int{}}
+				} else if err != nil {
+					return err
+				}
+				// a resource inserted by a rebuild keeps its own votes and prior, and gains the legacy counts
+				prior := legacyPrior(scores[key], counts[key])
+				for label, count := range resource.Prior {
+					prior[label] += count
+				}
+				resource.setPrior(prior, "true", resource.Priority)
+				_, err = setResource(txn, resource)
+				if err != nil {
+					return err
+				}
+				err = txn.Delete([]byte(key))
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return
+		}
+		resources = end
+	}
+	err = os.RemoveAll(countPath)
+	return
+}
@@ -0,0 +1,356 @@
+package db
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+)
+
+// memoryStore is a Store kept in memory, for tests and throwaway databases.
+// Resources are kept encoded, like in Badger, so the records it returns never share maps with the stored ones.
+type memoryStore struct {
+	mutex     sync.Mutex
+	resources map[string][]byte
+	votes     map[string]map[string]VoteRecord
+	skips     map[string]map[string]SkipRecord
+	hashes    map[string]string
+	queue     *queue
+}
+
+// NewMemoryStore creates an empty Store kept in memory, which is lost along with it.
+func NewMemoryStore() Store {
+	return &memoryStore{
+		resources: map[string][]byte{},
+		votes:     map[string]map[string]VoteRecord{},
+		skips:     map[string]map[string]SkipRecord{},
+		hashes:    map[string]string{},
+		queue:     newQueue(),
+	}
+}
+
+// get reads a resource. The caller must hold the store mutex.
+func (s *memoryStore) get(key string) (Resource, error) {
+	value, ok := s.resources[key]
+	if !ok {
+		return Resource{}, ErrNotFound
+	}
+	return decodeResource(value)
+}
+
+// set writes a resource, refreshing its winning label and completion, and moves it inside the scheduling queue.
+// The caller must hold the store mutex.
+func (s *memoryStore) set(resource Resource) error {
+	resource.refresh()
+	value, err := json.Marshal(resource)
+	if err != nil {
+		return err
+	}
+	s.resources[resource.Key] = value
+	s.queue.set(resource)
+	return nil
+}
+
+// modify applies fn to the resource stored under key.
+func (s *memoryStore) modify(key string, fn func(resource *Resource)) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	resource, err := s.get(key)
+	if err != nil {
+		return err
+	}
+	fn(&resource)
+	return s.set(resource)
+}
+
+// sortedKeys returns the keys of the stored resources in order. The caller must hold the store mutex.
+func (s *memoryStore) sortedKeys() []string {
+	keys := make([]string, 0, len(s.resources))
+	for key := range s.resources {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (s *memoryStore) InsertResource(key string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.resources[key]; ok {
+		return ErrKeyExists
+	}
+	return s.set(Resource{Key: key, Labels: map[string]int{}})
+}
+
+func (s *memoryStore) InsertFile(key string, hash string) (string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	canonical := s.hashes[hash]
+	if canonical != "" && canonical != key {
+		resource, err := s.get(canonical)
+		if err != nil {
+			return canonical, err
+		}
+		for _, duplicate := range resource.Duplicates {
+			if duplicate == key {
+				return canonical, ErrDuplicateContent
+			}
+		}
+		resource.Duplicates = append(resource.Duplicates, key)
+		sort.Strings(resource.Duplicates)
+		err = s.set(resource)
+		if err != nil {
+			return canonical, err
+		}
+		return canonical, ErrDuplicateContent
+	}
+	resource, err := s.get(key)
+	if err == nil && resource.Hash != "" {
+		return key, ErrKeyExists
+	}
+	existed := err == nil
+	if !existed {
+		resource = Resource{Key: key, Labels: map[string]int{}}
+	}
+	resource.Hash = hash
+	s.hashes[hash] = key
+	err = s.set(resource)
+	if err == nil && existed {
+		err = ErrKeyExists
+	}
+	return key, err
+}
+
+func (s *memoryStore) GetResource(key string) (Resource, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.get(key)
+}
+
+func (s *memoryStore) CastVote(record VoteRecord) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	resource, err := s.get(record.Key)
+	if err != nil {
+		return err
+	}
+	if _, ok := s.votes[record.Key][record.Annotator]; ok {
+		return ErrDuplicateVote
+	}
+	if s.votes[record.Key] == nil {
+		s.votes[record.Key] = map[string]VoteRecord{}
+	}
+	s.votes[record.Key][record.Annotator] = record
+	resource.addVote(record)
+	err = s.set(resource)
+	if err == nil {
+		s.queue.answer(record.Key, record.Annotator)
+	}
+	return err
+}
+
+func (s *memoryStore) RetractVote(key string, annotator string) (VoteRecord, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	record, ok := s.votes[key][annotator]
+	if !ok {
+		return record, ErrVoteNotFound
+	}
+	resource, err := s.get(key)
+	if err != nil {
+		return record, err
+	}
+	resource.removeVote(record)
+	delete(s.votes[key], annotator)
+	err = s.set(resource)
+	if err == nil {
+		s.queue.unanswer(key, annotator)
+	}
+	return record, err
+}
+
+func (s *memoryStore) SkipResource(record SkipRecord) error {
+	if record.Reason == "" {
+		record.Reason = "unspecified"
+	} else if !validReason(record.Reason) {
+		return ErrUnknownReason
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	resource, err := s.get(record.Key)
+	if err != nil {
+		return err
+	}
+	if _, ok := s.skips[record.Key][record.Annotator]; ok {
+		return ErrDuplicateSkip
+	}
+	if s.skips[record.Key] == nil {
+		s.skips[record.Key] = map[string]SkipRecord{}
+	}
+	s.skips[record.Key][record.Annotator] = record
+	resource.addSkip(record)
+	err = s.set(resource)
+	if err == nil {
+		s.queue.answer(record.Key, record.Annotator)
+	}
+	return err
+}
+
+// voteRecords returns the votes cast on key, sorted by annotator like the records of Badger. The caller must hold the store mutex.
+func (s *memoryStore) voteRecords(key string) []VoteRecord {
+	var list []VoteRecord
+	for _, record := range s.votes[key] {
+		list = append(list, record)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Annotator < list[j].Annotator })
+	return list
+}
+
+func (s *memoryStore) GetVoteRecords(key string) ([]VoteRecord, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.voteRecords(key), nil
+}
+
+func (s *memoryStore) GetSortedKey(annotator string) (string, error) {
+	return s.GetNewSortedKey("", annotator)
+}
+
+func (s *memoryStore) GetNewSortedKey(lastkey string, annotator string) (string, error) {
+	key, ok := s.queue.next(lastkey, annotator, LeaseTTL)
+	if !ok {
+		return "", ErrNotFound
+	}
+	return key, nil
+}
+
+func (s *memoryStore) CountDBSize() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.resources)
+}
+
+func (s *memoryStore) GetCurrentVotes() (list []Resource, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, key := range s.sortedKeys() {
+		resource, err := s.get(key)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, resource)
+	}
+	return list, nil
+}
+
+// IterateResources reads every resource before calling fn, so fn can use the store.
+func (s *memoryStore) IterateResources(fn func(resource Resource, votes []VoteRecord) error) error {
+	s.mutex.Lock()
+	keys := s.sortedKeys()
+	resources := make([]Resource, len(keys))
+	votes := make([][]VoteRecord, len(keys))
+	for i, key := range keys {
+		resource, err := s.get(key)
+		if err != nil {
+			s.mutex.Unlock()
+			return err
+		}
+		resources[i], votes[i] = resource, s.voteRecords(key)
+	}
+	s.mutex.Unlock()
+	for i := range resources {
+		err := fn(resources[i], votes[i])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) GetDuplicates() (groups []DuplicateGroup, err error) {
+	err = s.IterateResources(func(resource Resource, votes []VoteRecord) error {
+		if len(resource.Duplicates) > 0 {
+			groups = append(groups, DuplicateGroup{Hash: resource.Hash, Canonical: resource.Key, Duplicates: resource.Duplicates})
+		}
+		return nil
+	})
+	return
+}
+
+func (s *memoryStore) SetPerceptualHash(key string, hash string) error {
+	return s.modify(key, func(resource *Resource) { resource.PerceptualHash = hash })
+}
+
+func (s *memoryStore) SetMetadata(key string, metadata Metadata) error {
+	return s.modify(key, func(resource *Resource) { resource.Metadata = &metadata })
+}
+
+func (s *memoryStore) SetOrphaned(key string, orphaned bool) error {
+	return s.modify(key, func(resource *Resource) { resource.Orphaned = orphaned })
+}
+
+func (s *memoryStore) SetPrior(key string, prior map[string]int, positive string, priority int) error {
+	return s.modify(key, func(resource *Resource) { resource.setPrior(prior, positive, priority) })
+}
+
+func (s *memoryStore) RemoveDuplicate(key string, path string) error {
+	return s.modify(key, func(resource *Resource) { resource.removeDuplicate(path) })
+}
+
+func (s *memoryStore) ReplaceContent(key string, hash string) ([]string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	resource, err := s.get(key)
+	if err != nil || resource.Hash == hash {
+		return nil, err
+	}
+	if resource.Hash != "" && s.hashes[resource.Hash] == key {
+		delete(s.hashes, resource.Hash)
+	}
+	if s.hashes[hash] == "" {
+		s.hashes[hash] = key
+	}
+	duplicates := resource.replaceContent(hash)
+	return duplicates, s.set(resource)
+}
+
+func (s *memoryStore) RenameResource(oldKey string, newKey string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	resource, err := s.get(oldKey)
+	if err != nil {
+		return err
+	}
+	if _, ok := s.resources[newKey]; ok {
+		return ErrKeyExists
+	}
+	if votes, ok := s.votes[oldKey]; ok {
+		for annotator, record := range votes {
+			record.Key = newKey
+			votes[annotator] = record
+		}
+		s.votes[newKey] = votes
+		delete(s.votes, oldKey)
+	}
+	if skips, ok := s.skips[oldKey]; ok {
+		for annotator, record := range skips {
+			record.Key = newKey
+			skips[annotator] = record
+		}
+		s.skips[newKey] = skips
+		delete(s.skips, oldKey)
+	}
+	delete(s.resources, oldKey)
+	if resource.Hash != "" {
+		s.hashes[resource.Hash] = newKey
+	}
+	resource.Key = newKey
+	resource.removeDuplicate(newKey)
+	resource.Orphaned = false
+	s.queue.rename(oldKey, newKey)
+	return s.set(resource)
+}
+
+// Close does nothing, since the records are dropped along with the store.
+func (s *memoryStore) Close() error {
+	return nil
+}
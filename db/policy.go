@@ -0,0 +1,45 @@
+package db
+
+// Policy decides when a resource received enough votes, or skips, to stop being scheduled.
+type Policy struct {
+	// MinVotes is the amount of votes a resource needs before its agreement is checked.
+	MinVotes int
+	// Agreement is the share of the votes the most voted label needs to finalize the resource, between 0 and 1.
+	Agreement float64
+	// MaxVotes finalizes a resource once reached, even without agreement. Zero means no limit.
+	MaxVotes int
+	// MaxSkips flags a resource once it was skipped this many times, for any reason. Zero means no limit.
+	MaxSkips int
+}
+
+// CompletionPolicy is applied to every resource read or written. The zero Policy never finalizes resources.
+var CompletionPolicy Policy
+
+// Done reports whether a resource reached consensus, or the maximum amount of votes.
+func (p Policy) Done(resource Resource) bool {
+	if p.MaxVotes > 0 && resource.TotalVotes >= p.MaxVotes {
+		return true
+	}
+	if p.Agreement <= 0 || resource.TotalVotes == 0 || resource.TotalVotes < p.MinVotes {
+		return false
+	}
+	best := 0
+	for _, amount := range resource.Labels {
+		if amount > best {
+			best = amount
+		}
+	}
+	return float64(best) >= p.Agreement*float64(resource.TotalVotes)
+}
+
+// Flagged reports whether a resource was skipped too many times.
+func (p Policy) Flagged(resource Resource) bool {
+	if p.MaxSkips <= 0 {
+		return false
+	}
+	skips := 0
+	for _, amount := range resource.Skips {
+		skips += amount
+	}
+	return skips >= p.MaxSkips
+}
@@ -0,0 +1,316 @@
+package db
+
+import (
+	"container/heap"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger"
+)
+
+// LeaseTTL is how long a key handed to an annotator stays reserved for them, unless they vote on it or ask for another key first.
+var LeaseTTL = 5 * time.Minute
+
+// queueItem is a resource waiting to be voted, positioned inside the scheduling queue by its priority and amount of votes.
+// Items leased to an annotator are kept out of the heap, with a negative index.
+type queueItem struct {
+	key      string
+	priority int
+	votes    int
+	index    int
+}
+
+// queueHeap implements heap.Interface, keeping the least voted resource of the highest priority at the top. Ties are broken by key.
+type queueHeap []*queueItem
+
+func (h queueHeap) Len() int { return len(h) }
+
+func (h queueHeap) Less(i, j int) bool {
+	if h[i].priority != h[j].priority {
+		return h[i].priority > h[j].priority
+	}
+	if h[i].votes == h[j].votes {
+		return h[i].key < h[j].key
+	}
+	return h[i].votes < h[j].votes
+}
+
+func (h queueHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *queueHeap) Push(x interface{}) {
+	item := x.(*queueItem)
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+
+func (h *queueHeap) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return item
+}
+
+// lease reserves a key for an annotator until it expires.
+type lease struct {
+	annotator string
+	expires   time.Time
+}
+
+// queue is the in-memory scheduling index of a database, so the least voted resource is found in O(log n) instead of scanning every record.
+// It is built from the database on first use and updated after every committed write.
+// Every annotator holds at most one lease, on the key they are currently looking at,
+// and is never handed the keys they already voted on or skipped, counted by answered.
+type queue struct {
+	mutex    sync.Mutex
+	heap     queueHeap
+	items    map[string]*queueItem
+	leases   map[string]lease
+	holders  map[string]string
+	answered map[string]map[string]int
+}
+
+var (
+	queuesMutex sync.Mutex
+	queues      = map[*badger.DB]*queue{}
+)
+
+// queueFor returns the scheduling queue of a database, building it from the stored resources the first time it is used.
+func queueFor(dbpointer *badger.DB) *queue {
+	queuesMutex.Lock()
+	defer queuesMutex.Unlock()
+	q, ok := queues[dbpointer]
+	if ok {
+		return q
+	}
+	q = newQueue()
+	_ = dbpointer.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		it := txn.NewIterator(opts)
+		prefix := []byte(resourcePrefix)
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			val, err := it.Item().Value()
+			if err != nil {
+				return err
+			}
+			resource, err := decodeResource(val)
+			if err != nil {
+				return err
+			}
+			q.set(resource)
+		}
+		it.Close()
+		opts.PrefetchValues = false
+		for _, prefix := range []string{recordPrefix, skipPrefix} {
+			records := txn.NewIterator(opts)
+			for records.Seek([]byte(prefix)); records.ValidForPrefix([]byte(prefix)); records.Next() {
+				q.answer(recordOwner(records.Item().Key(), prefix))
+			}
+			records.Close()
+		}
+		return nil
+	})
+	queues[dbpointer] = q
+	return q
+}
+
+// newQueue creates an empty scheduling queue.
+func newQueue() *queue {
+	return &queue{items: map[string]*queueItem{}, leases: map[string]lease{}, holders: map[string]string{}, answered: map[string]map[string]int{}}
+}
+
+// recordOwner returns the resource key and the annotator of a vote or skip record stored under dbKey, which starts with prefix.
+func recordOwner(dbKey []byte, prefix string) (key string, annotator string) {
+	owner := strings.TrimPrefix(string(dbKey), prefix)
+	separator := strings.LastIndex(owner, "\x00")
+	if separator < 0 {
+		return owner, ""
+	}
+	return owner[:separator], owner[separator+1:]
+}
+
+// forgetQueue drops the scheduling queue of a database, and should be called when it is closed.
+func forgetQueue(dbpointer *badger.DB) {
+	queuesMutex.Lock()
+	defer queuesMutex.Unlock()
+	delete(queues, dbpointer)
+}
+
+// set inserts a resource in the queue, or moves it to its new position. Finalized and flagged resources are removed from the queue.
+func (q *queue) set(resource Resource) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	item, ok := q.items[resource.Key]
+	if !resource.scheduled() {
+		if ok {
+			q.remove(item)
+		}
+		return
+	}
+	if !ok {
+		item = &queueItem{key: resource.Key, priority: resource.Priority, votes: resource.TotalVotes}
+		q.items[resource.Key] = item
+		heap.Push(&q.heap, item)
+		return
+	}
+	item.priority = resource.Priority
+	item.votes = resource.TotalVotes
+	if item.index >= 0 {
+		heap.Fix(&q.heap, item.index)
+	}
+}
+
+// next returns the least voted key that is different from exclude, and that annotator did not vote on or skip, leasing it to annotator for ttl.
+// Annotators already holding a lease on another key get it renewed instead, and anonymous annotators never lease keys.
+func (q *queue) next(exclude string, annotator string, ttl time.Duration) (key string, ok bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	now := time.Now()
+	q.expire(now)
+	if held, ok := q.holders[annotator]; ok && annotator != "" {
+		if held != exclude {
+			q.leases[held] = lease{annotator: annotator, expires: now.Add(ttl)}
+			return held, true
+		}
+		q.unlease(held)
+	}
+	// answered items stay in the heap, and are passed over without being popped
+	answered := q.answered[annotator]
+	item := q.peek(func(top *queueItem) bool {
+		return top.key != exclude && answered[top.key] == 0
+	})
+	if item == nil {
+		return "", false
+	}
+	if annotator == "" {
+		return item.key, true
+	}
+	heap.Remove(&q.heap, item.index)
+	item.index = -1
+	q.leases[item.key] = lease{annotator: annotator, expires: now.Add(ttl)}
+	q.holders[annotator] = item.key
+	return item.key, true
+}
+
+// peek returns the first item of the heap, in queue order, that accept takes, leaving the heap unchanged.
+// The heap is walked from its top, only reaching the children of the items refused, so the cost grows with the amount of items
+// passed over rather than with the size of the heap. The caller must hold the queue mutex.
+func (q *queue) peek(accept func(item *queueItem) bool) *queueItem {
+	if len(q.heap) == 0 {
+		return nil
+	}
+	frontier := &heapFrontier{heap: q.heap, indexes: []int{0}}
+	for frontier.Len() > 0 {
+		index := heap.Pop(frontier).(int)
+		if accept(q.heap[index]) {
+			return q.heap[index]
+		}
+		for _, child := range []int{2*index + 1, 2*index + 2} {
+			if child < len(q.heap) {
+				heap.Push(frontier, child)
+			}
+		}
+	}
+	return nil
+}
+
+// heapFrontier implements heap.Interface over positions of a queueHeap, ordering them like the items they hold.
+type heapFrontier struct {
+	heap    queueHeap
+	indexes []int
+}
+
+func (f *heapFrontier) Len() int { return len(f.indexes) }
+
+func (f *heapFrontier) Less(i, j int) bool { return f.heap.Less(f.indexes[i], f.indexes[j]) }
+
+func (f *heapFrontier) Swap(i, j int) { f.indexes[i], f.indexes[j] = f.indexes[j], f.indexes[i] }
+
+func (f *heapFrontier) Push(x interface{}) { f.indexes = append(f.indexes, x.(int)) }
+
+func (f *heapFrontier) Pop() interface{} {
+	index := f.indexes[len(f.indexes)-1]
+	f.indexes = f.indexes[:len(f.indexes)-1]
+	return index
+}
+
+// answer records that annotator voted on or skipped key, so it is not handed to them again, and gives back the lease they hold on it, if any.
+func (q *queue) answer(key string, annotator string) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if l, ok := q.leases[key]; ok && l.annotator == annotator {
+		q.unlease(key)
+	}
+	if annotator == "" {
+		return
+	}
+	if q.answered[annotator] == nil {
+		q.answered[annotator] = map[string]int{}
+	}
+	q.answered[annotator][key]++
+}
+
+// unanswer forgets one vote or skip of annotator on key, after a vote is retracted.
+func (q *queue) unanswer(key string, annotator string) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	answered := q.answered[annotator]
+	if answered[key] > 1 {
+		answered[key]--
+	} else {
+		delete(answered, key)
+	}
+}
+
+// expire gives back every lease that expired before now. Leases are bound by the amount of active annotators, so they are simply scanned.
+func (q *queue) expire(now time.Time) {
+	for key, l := range q.leases {
+		if now.After(l.expires) {
+			q.unlease(key)
+		}
+	}
+}
+
+// remove takes an item out of the queue, dropping its lease. The caller must hold the queue mutex.
+func (q *queue) remove(item *queueItem) {
+	if l, ok := q.leases[item.key]; ok {
+		delete(q.leases, item.key)
+		delete(q.holders, l.annotator)
+	}
+	if item.index >= 0 {
+		heap.Remove(&q.heap, item.index)
+	}
+	delete(q.items, item.key)
+}
+
+// unlease removes the lease on key and puts its item back in the heap. The caller must hold the queue mutex.
+func (q *queue) unlease(key string) {
+	l := q.leases[key]
+	delete(q.leases, key)
+	delete(q.holders, l.annotator)
+	item, ok := q.items[key]
+	if ok && item.index < 0 {
+		heap.Push(&q.heap, item)
+	}
+}
+
+// rename removes oldKey from the queue, for resources moved to newKey, and moves the answers given on it along.
+// The resource is put back in the queue by the following set.
+func (q *queue) rename(oldKey string, newKey string) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if item, ok := q.items[oldKey]; ok {
+		q.remove(item)
+	}
+	for _, answered := range q.answered {
+		if count, ok := answered[oldKey]; ok {
+			answered[newKey] += count
+			delete(answered, oldKey)
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package db
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/dgraph-io/badger"
+)
+
+// SetOrphaned records whether the file of key is missing. Orphaned resources keep their votes, but are not scheduled.
+func SetOrphaned(key string, orphaned bool, dbpointer *badger.DB) error {
+	return update(dbpointer, key, func(txn *badger.Txn) (Resource, error) {
+		resource, err := getResource(txn, key)
+		if err != nil {
+			return resource, err
+		}
+		resource.Orphaned = orphaned
+		return setResource(txn, resource)
+	})
+}
+
+// SetPrior seeds the label counts of the resource stored under key with prior, such as the labels of an earlier dataset or
+// the predictions of a model, and sets its scheduling priority. Prior counts on positive add to its score, and the other ones subtract from it.
+// The prior seeded before is replaced, so importing the same counts twice does not count them twice.
+func SetPrior(key string, prior map[string]int, positive string, priority int, dbpointer *badger.DB) error {
+	return update(dbpointer, key, func(txn *badger.Txn) (Resource, error) {
+		resource, err := getResource(txn, key)
+		if err != nil {
+			return resource, err
+		}
+		resource.setPrior(prior, positive, priority)
+		return setResource(txn, resource)
+	})
+}
+
+// setPrior replaces the prior label counts and the priority of a resource, as described by SetPrior.
+func (r *Resource) setPrior(prior map[string]int, positive string, priority int) {
+	if r.Labels == nil {
+		r.Labels = map[string]int{}
+	}
+	apply := func(counts map[string]int, sign int) {
+		for label, count := range counts {
+			score := -count
+			if label == positive {
+				score = count
+			}
+			r.Vote += sign * score
+			r.TotalVotes += sign * count
+			r.Labels[label] += sign * count
+			if r.Labels[label] <= 0 {
+				delete(r.Labels, label)
+			}
+		}
+	}
+	apply(r.Prior, -1)
+	apply(prior, 1)
+	r.Prior = nil
+	for label, count := range prior {
+		if count > 0 {
+			if r.Prior == nil {
+				r.Prior = map[string]int{}
+			}
+			r.Prior[label] = count
+		}
+	}
+	r.Priority = priority
+}
+
+// RemoveDuplicate drops path from the duplicates of the resource stored under key.
+func RemoveDuplicate(key string, path string, dbpointer *badger.DB) error {
+	return update(dbpointer, key, func(txn *badger.Txn) (Resource, error) {
+		resource, err := getResource(txn, key)
+		if err != nil {
+			return resource, err
+		}
+		resource.removeDuplicate(path)
+		return setResource(txn, resource)
+	})
+}
+
+// removeDuplicate drops path from the duplicates of a resource.
+func (r *Resource) removeDuplicate(path string) {
+	var duplicates []string
+	for _, duplicate := range r.Duplicates {
+		if duplicate != path {
+			duplicates = append(duplicates, duplicate)
+		}
+	}
+	r.Duplicates = duplicates
+}
+
+// ReplaceContent records that the file of the resource stored under key now holds content with the provided hash, keeping its votes.
+// The paths holding its previous content are dropped from its duplicates and returned, so they can be inserted on their own,
+// and the new content is indexed under key unless another resource already holds it. Nothing changes when the hash is the same.
+func ReplaceContent(key string, hash string, dbpointer *badger.DB) (duplicates []string, err error) {
+	err = update(dbpointer, key, func(txn *badger.Txn) (Resource, error) {
+		duplicates = nil
+		resource, err := getResource(txn, key)
+		if err != nil || resource.Hash == hash {
+			return resource, err
+		}
+		if resource.Hash != "" {
+			canonical, err := getCanonical(txn, resource.Hash)
+			if err != nil {
+				return resource, err
+			} else if canonical == key {
+				err = txn.Delete(hashKey(resource.Hash))
+				if err != nil {
+					return resource, err
+				}
+			}
+		}
+		canonical, err := getCanonical(txn, hash)
+		if err != nil {
+			return resource, err
+		} else if canonical == "" {
+			err = txn.Set(hashKey(hash), []byte(key))
+			if err != nil {
+				return resource, err
+			}
+		}
+		duplicates = resource.replaceContent(hash)
+		return setResource(txn, resource)
+	})
+	return
+}
+
+// replaceContent records the new content hash of a resource, and returns the duplicates of its previous content.
+func (r *Resource) replaceContent(hash string) (duplicates []string) {
+	duplicates, r.Duplicates = r.Duplicates, nil
+	r.Hash = hash
+	return
+}
+
+// RenameResource moves the resource stored under oldKey to newKey, with the votes and skips recorded on it, for files that were moved.
+// newKey is removed from the duplicates of the resource, and the resource stops being orphaned.
+// It fails with ErrKeyExists if newKey is already a resource, and with badger.ErrKeyNotFound if oldKey is not.
+func RenameResource(oldKey string, newKey string, dbpointer *badger.DB) error {
+	// both keys are locked in the order of their locks, so concurrent renames can not deadlock
+	first, second := lockIndex(oldKey), lockIndex(newKey)
+	if first > second {
+		first, second = second, first
+	}
+	keyLocks[first].Lock()
+	defer keyLocks[first].Unlock()
+	if second != first {
+		keyLocks[second].Lock()
+		defer keyLocks[second].Unlock()
+	}
+	for {
+		var resource Resource
+		err := dbpointer.Update(func(txn *badger.Txn) (err error) {
+			resource, err = renameResource(txn, oldKey, newKey)
+			return
+		})
+		if err == nil {
+			queueFor(dbpointer).rename(oldKey, newKey)
+			queueFor(dbpointer).set(resource)
+		}
+		if err != badger.ErrConflict {
+			return err
+		}
+	}
+}
+
+// renameResource moves a resource and its records inside a transaction.
+func renameResource(txn *badger.Txn, oldKey string, newKey string) (Resource, error) {
+	resource, err := getResource(txn, oldKey)
+	if err != nil {
+		return resource, err
+	}
+	_, err = txn.Get(resourceKey(newKey))
+	if err == nil {
+		return resource, ErrKeyExists
+	} else if err != badger.ErrKeyNotFound {
+		return resource, err
+	}
+	err = moveRecords(txn, recordKey(oldKey, ""), recordKey(newKey, ""), newKey)
+	if err != nil {
+		return resource, err
+	}
+	err = moveRecords(txn, skipKey(oldKey, ""), skipKey(newKey, ""), newKey)
+	if err != nil {
+		return resource, err
+	}
+	err = txn.Delete(resourceKey(oldKey))
+	if err != nil {
+		return resource, err
+	}
+	if resource.Hash != "" {
+		err = txn.Set(hashKey(resource.Hash), []byte(newKey))
+		if err != nil {
+			return resource, err
+		}
+	}
+	resource.Key = newKey
+	resource.removeDuplicate(newKey)
+	resource.Orphaned = false
+	return setResource(txn, resource)
+}
+
+// moveRecords moves every vote or skip record stored under oldPrefix to newPrefix, updating the key they hold.
+// Records are read before being moved, since a transaction can not write while an iterator is open.
+func moveRecords(txn *badger.Txn, oldPrefix []byte, newPrefix []byte, newKey string) error {
+	var keys, values [][]byte
+	it := txn.NewIterator(badger.DefaultIteratorOptions)
+	for it.Seek(oldPrefix); it.ValidForPrefix(oldPrefix); it.Next() {
+		val, err := it.Item().Value()
+		if err != nil {
+			it.Close()
+			return err
+		}
+		keys = append(keys, it.Item().KeyCopy(nil))
+		values = append(values, append([]byte{}, val...))
+	}
+	it.Close()
+	for i, key := range keys {
+		var record map[string]interface{}
+		err := json.Unmarshal(values[i], &record)
+		if err != nil {
+			return err
+		}
+		record["Key"] = newKey
+		value, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		err = txn.Delete(key)
+		if err != nil {
+			return err
+		}
+		err = txn.Set(append(append([]byte{}, newPrefix...), bytes.TrimPrefix(key, oldPrefix)...), value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
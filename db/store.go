@@ -0,0 +1,154 @@
+package db
+
+import (
+	"errors"
+
+	"github.com/dgraph-io/badger"
+)
+
+// Storage engines accepted by OpenEngine.
+const (
+	EngineBadger = "badger"
+	EngineBolt   = "bolt"
+)
+
+var (
+	// ErrNotFound is returned by every Store for keys that are not in the database.
+	ErrNotFound = badger.ErrKeyNotFound
+	// ErrUnknownEngine is returned by OpenEngine for engines other than EngineBadger and EngineBolt.
+	ErrUnknownEngine = errors.New("Unknown storage engine")
+)
+
+// Store is a voting database, holding the resources, the votes and skips recorded on them, and their scheduling queue.
+// Its methods behave like the package functions of the same name, which implement the Badger store.
+type Store interface {
+	InsertResource(key string) error
+	InsertFile(key string, hash string) (canonical string, err error)
+	GetResource(key string) (Resource, error)
+	CastVote(record VoteRecord) error
+	RetractVote(key string, annotator string) (VoteRecord, error)
+	SkipResource(record SkipRecord) error
+	GetVoteRecords(key string) ([]VoteRecord, error)
+	GetSortedKey(annotator string) (string, error)
+	GetNewSortedKey(lastkey string, annotator string) (string, error)
+	CountDBSize() int
+	GetCurrentVotes() ([]Resource, error)
+	IterateResources(fn func(resource Resource, votes []VoteRecord) error) error
+	GetDuplicates() ([]DuplicateGroup, error)
+	SetPerceptualHash(key string, hash string) error
+	SetMetadata(key string, metadata Metadata) error
+	SetOrphaned(key string, orphaned bool) error
+	SetPrior(key string, prior map[string]int, positive string, priority int) error
+	RemoveDuplicate(key string, path string) error
+	ReplaceContent(key string, hash string) (duplicates []string, err error)
+	RenameResource(oldKey string, newKey string) error
+	Close() error
+}
+
+// badgerStore is the Store kept in a Badger database.
+type badgerStore struct {
+	db *badger.DB
+}
+
+// Open opens, or creates, the Badger database at databasePath as a Store.
+// It fails with ErrLegacyDatabase for databases written in the legacy score format, which must be converted by UpgradeLegacy first.
+func Open(databasePath string) (Store, error) {
+	dbpointer, err := Init(databasePath)
+	if err != nil {
+		return nil, err
+	}
+	legacy, err := hasLegacyKeys(dbpointer)
+	if err == nil && legacy {
+		err = ErrLegacyDatabase
+	}
+	if err != nil {
+		Close(dbpointer)
+		return nil, err
+	}
+	return NewBadgerStore(dbpointer), nil
+}
+
+// OpenEngine opens the database at databasePath with the storage engine named engine: a Badger folder for EngineBadger,
+// the default, or a single bbolt file for EngineBolt.
+func OpenEngine(engine string, databasePath string) (Store, error) {
+	switch engine {
+	case "", EngineBadger:
+		return Open(databasePath)
+	case EngineBolt:
+		return OpenBolt(databasePath)
+	}
+	return nil, ErrUnknownEngine
+}
+
+// NewBadgerStore uses an open Badger database as a Store. Closing the store closes the database.
+func NewBadgerStore(dbpointer *badger.DB) Store {
+	return badgerStore{db: dbpointer}
+}
+
+func (s badgerStore) InsertResource(key string) error { return InsertResource(key, s.db) }
+
+func (s badgerStore) InsertFile(key string, hash string) (string, error) {
+	return InsertFile(key, hash, s.db)
+}
+
+func (s badgerStore) GetResource(key string) (Resource, error) { return GetResource(key, s.db) }
+
+func (s badgerStore) CastVote(record VoteRecord) error { return CastVote(record, s.db) }
+
+func (s badgerStore) RetractVote(key string, annotator string) (VoteRecord, error) {
+	return RetractVote(key, annotator, s.db)
+}
+
+func (s badgerStore) SkipResource(record SkipRecord) error { return SkipResource(record, s.db) }
+
+func (s badgerStore) GetVoteRecords(key string) ([]VoteRecord, error) {
+	return GetVoteRecords(key, s.db)
+}
+
+func (s badgerStore) GetSortedKey(annotator string) (string, error) {
+	return GetSortedKey(s.db, annotator)
+}
+
+func (s badgerStore) GetNewSortedKey(lastkey string, annotator string) (string, error) {
+	return GetNewSortedKey(s.db, lastkey, annotator)
+}
+
+func (s badgerStore) CountDBSize() int { return CountDBSize(s.db) }
+
+func (s badgerStore) GetCurrentVotes() ([]Resource, error) { return GetCurrentVotes(s.db) }
+
+func (s badgerStore) IterateResources(fn func(resource Resource, votes []VoteRecord) error) error {
+	return IterateResources(s.db, fn)
+}
+
+func (s badgerStore) GetDuplicates() ([]DuplicateGroup, error) { return GetDuplicates(s.db) }
+
+func (s badgerStore) SetPerceptualHash(key string, hash string) error {
+	return SetPerceptualHash(key, hash, s.db)
+}
+
+func (s badgerStore) SetMetadata(key string, metadata Metadata) error {
+	return SetMetadata(key, metadata, s.db)
+}
+
+func (s badgerStore) SetOrphaned(key string, orphaned bool) error {
+	return SetOrphaned(key, orphaned, s.db)
+}
+
+func (s badgerStore) SetPrior(key string, prior map[string]int, positive string, priority int) error {
+	return SetPrior(key, prior, positive, priority, s.db)
+}
+
+func (s badgerStore) RemoveDuplicate(key string, path string) error {
+	return RemoveDuplicate(key, path, s.db)
+}
+
+func (s badgerStore) ReplaceContent(key string, hash string) ([]string, error) {
+	return ReplaceContent(key, hash, s.db)
+}
+
+func (s badgerStore) RenameResource(oldKey string, newKey string) error {
+	return RenameResource(oldKey, newKey, s.db)
+}
+
+func (s badgerStore) Close() error { return Close(s.db) }
@@ -0,0 +1,154 @@
+package export
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Archive formats streamed by WriteArchive.
+const (
+	FormatZip   = "zip"
+	FormatTarGz = "tar.gz"
+)
+
+// ErrUnknownFormat is returned when asking for an archive format WriteArchive can not write.
+var ErrUnknownFormat = errors.New("Unknown archive format")
+
+// archiveWriter adds entries to a zip or tar.gz archive.
+type archiveWriter interface {
+	add(name string, size int64, modified time.Time, content io.Reader) error
+	Close() error
+}
+
+// zipWriter adds entries to a zip archive.
+type zipWriter struct {
+	writer *zip.Writer
+}
+
+func (w zipWriter) add(name string, size int64, modified time.Time, content io.Reader) error {
+	header := &zip.FileHeader{Name: name, Method: zip.Deflate}
+	header.SetModTime(modified)
+	entry, err := w.writer.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(entry, content)
+	return err
+}
+
+func (w zipWriter) Close() error {
+	return w.writer.Close()
+}
+
+// tarGzWriter adds entries to a gzip compressed tar archive.
+type tarGzWriter struct {
+	writer *tar.Writer
+	gzip   *gzip.Writer
+}
+
+func (w tarGzWriter) add(name string, size int64, modified time.Time, content io.Reader) error {
+	err := w.writer.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: size, ModTime: modified, Typeflag: tar.TypeReg})
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyN(w.writer, content, size)
+	return err
+}
+
+func (w tarGzWriter) Close() error {
+	err := w.writer.Close()
+	if err != nil {
+		return err
+	}
+	return w.gzip.Close()
+}
+
+// newArchiveWriter creates the writer of format on top of w.
+func newArchiveWriter(w io.Writer, format string) (archiveWriter, error) {
+	switch format {
+	case FormatZip:
+		return zipWriter{writer: zip.NewWriter(w)}, nil
+	case FormatTarGz:
+		compressed := gzip.NewWriter(w)
+		return tarGzWriter{writer: tar.NewWriter(compressed), gzip: compressed}, nil
+	}
+	return nil, ErrUnknownFormat
+}
+
+// WriteArchive streams files and manifests into w as a format archive, reading every picture from disk as it is written.
+// Files are placed at their Destination, which should be relative, manifests are encoded as the ones of Manager.Start, and manifest.json is written last, listing the files
+// that were archived and the ones that could not be read. A cancelled ctx stops the archive before its next file.
+func WriteArchive(ctx context.Context, w io.Writer, format string, files []File, manifests map[string]interface{}) error {
+	archive, err := newArchiveWriter(w, format)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(manifests))
+	for name := range manifests {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	started := time.Now()
+	for _, name := range names {
+		err = addManifest(archive, name, manifests[name], started)
+		if err != nil {
+			return err
+		}
+	}
+	status := Job{Status: StatusDone, Destination: format, Total: len(files), Errors: []string{}, Started: started}
+	for _, file := range files {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		openErr, err := addFile(archive, file)
+		if err != nil {
+			// the entry was started, so the archive can not go on, whether the picture or the archive failed
+			return err
+		} else if openErr != nil {
+			status.Failed++
+			status.Errors = append(status.Errors, file.Source+": "+openErr.Error())
+			continue
+		}
+		status.Copied++
+		status.Manifest = append(status.Manifest, file)
+	}
+	status.Finished = time.Now()
+	err = addManifest(archive, "manifest.json", status, status.Finished)
+	if err != nil {
+		return err
+	}
+	return archive.Close()
+}
+
+// addFile adds the picture of file to the archive at its destination. Pictures that can not be opened are reported as openErr,
+// leaving the archive untouched, while err reports a failure once their entry is started, which leaves the archive truncated.
+func addFile(archive archiveWriter, file File) (openErr error, err error) {
+	input, openErr := os.Open(file.Source)
+	if openErr != nil {
+		return openErr, nil
+	}
+	defer input.Close()
+	info, openErr := input.Stat()
+	if openErr != nil {
+		return openErr, nil
+	}
+	return nil, archive.add(filepath.ToSlash(file.Destination), info.Size(), info.ModTime(), input)
+}
+
+// addManifest adds value to the archive, encoded as encodeManifest does.
+func addManifest(archive archiveWriter, name string, value interface{}, modified time.Time) error {
+	content, err := encodeManifest(value)
+	if err != nil {
+		return err
+	}
+	return archive.add(name, int64(len(content)), modified, bytes.NewReader(content))
+}
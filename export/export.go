@@ -0,0 +1,113 @@
+// Package export copies the pictures selected from the voting database into dataset folders.
+// Every export runs in the background as a Job, with bounded concurrency, progress counters and cancellation.
+package export
+
+import (
+	"path/filepath"
+
+	"github.com/auyer/colab-dataset/db"
+)
+
+// Folder names of the binary class layout.
+const (
+	Positive  = "positive"
+	Negative  = "negative"
+	Undecided = "undecided"
+)
+
+// Classifier returns the class folder a resource is exported into.
+type Classifier func(db.Resource) string
+
+// Unflagged splits the resources into the ones that can be exported, and the flagged ones.
+// Flagged resources were skipped too many times to be trusted, so they are never exported.
+// Orphaned resources lost their file, so they are left out of both.
+func Unflagged(resources []db.Resource) (kept []db.Resource, flagged []db.Resource) {
+	for _, item := range resources {
+		if item.Orphaned {
+			continue
+		} else if item.Flagged {
+			flagged = append(flagged, item)
+		} else {
+			kept = append(kept, item)
+		}
+	}
+	return
+}
+
+// Select splits the resources into the ones scoring at least cut times their amount of votes, and the flagged ones.
+func Select(resources []db.Resource, cut float64) (selected []db.Resource, flagged []db.Resource) {
+	kept, flagged := Unflagged(resources)
+	for _, item := range kept {
+		if float64(item.Vote) >= float64(item.TotalVotes)*cut {
+			selected = append(selected, item)
+		}
+	}
+	return
+}
+
+// SelectWinners splits the resources into the ones whose winning label holds at least agreement of their votes, and the flagged ones.
+// It replaces Select when more than two labels are configured, where the score only opposes the first label to every other one.
+func SelectWinners(resources []db.Resource, agreement float64) (selected []db.Resource, flagged []db.Resource) {
+	kept, flagged := Unflagged(resources)
+	classify := LabelClassifier(agreement)
+	for _, item := range kept {
+		if classify(item) != Undecided {
+			selected = append(selected, item)
+		}
+	}
+	return
+}
+
+// BinaryClassifier places resources scoring at least accept times their amount of votes in the positive folder,
+// the ones scoring at most reject times their amount of votes in the negative folder, and every other one in the undecided folder.
+func BinaryClassifier(accept, reject float64) Classifier {
+	return func(item db.Resource) string {
+		if item.TotalVotes == 0 {
+			return Undecided
+		}
+		ratio := float64(item.Vote) / float64(item.TotalVotes)
+		if ratio >= accept {
+			return Positive
+		} else if ratio <= reject {
+			return Negative
+		}
+		return Undecided
+	}
+}
+
+// LabelClassifier places resources in the folder of their winning label when it holds at least agreement of their votes,
+// and every other one in the undecided folder.
+func LabelClassifier(agreement float64) Classifier {
+	return func(item db.Resource) string {
+		if item.Winner == "" || float64(item.Labels[item.Winner]) < agreement*float64(item.TotalVotes) {
+			return Undecided
+		}
+		return item.Winner
+	}
+}
+
+// Files lists the copies placing every resource at its own relative path inside destination.
+// Resources are placed under the folder of their split, unless splits only holds the empty name,
+// and under the folder of their class when classify is not nil.
+func Files(destination string, splits map[string][]db.Resource, classify Classifier) (files []File) {
+	for _, split := range append([]string{""}, SplitNames...) {
+		for _, item := range splits[split] {
+			file := File{Source: item.Key, Split: split, Resource: item}
+			if classify != nil {
+				file.Class = classify(item)
+			}
+			file.Destination = filepath.Join(destination, file.Split, file.Class, item.Key)
+			files = append(files, file)
+		}
+	}
+	return
+}
+
+// ClassManifest lists the keys inside each class folder.
+func ClassManifest(files []File) map[string][]string {
+	manifest := map[string][]string{}
+	for _, file := range files {
+		manifest[file.Class] = append(manifest[file.Class], file.Source)
+	}
+	return manifest
+}
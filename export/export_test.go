@@ -0,0 +1,508 @@
+package export
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/auyer/colab-dataset/db"
+)
+
+const testDir = "./export_test.go.tmp"
+
+// waitJob polls a job until it stops running.
+func waitJob(t *testing.T, manager *Manager, id string) Job {
+	for i := 0; i < 500; i++ {
+		job, err := manager.Get(id)
+		if err != nil {
+			t.Errorf("Unable to Get Job")
+			t.FailNow()
+		}
+		if job.Status != StatusRunning {
+			return job
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("Job did not finish in time")
+	t.FailNow()
+	return Job{}
+}
+
+func TestSelect(t *testing.T) {
+	resources := []db.Resource{
+		{Key: "accepted", Vote: 3, TotalVotes: 3},
+		{Key: "rejected", Vote: -1, TotalVotes: 3},
+		{Key: "flagged", Vote: 3, TotalVotes: 3, Flagged: true},
+	}
+	selected, flagged := Select(resources, 0.5)
+	if len(selected) != 1 || selected[0].Key != "accepted" {
+		t.Errorf("Expected only the accepted resource to be selected, got %v", selected)
+	}
+	if len(flagged) != 1 || flagged[0].Key != "flagged" {
+		t.Errorf("Expected the flagged resource to be listed apart, got %v", flagged)
+	}
+}
+
+func TestSelectWinners(t *testing.T) {
+	resources := []db.Resource{
+		{Key: "agreed", Vote: -2, TotalVotes: 3, Winner: "dog", Labels: map[string]int{"cat": 0, "dog": 3}},
+		{Key: "split", Vote: -1, TotalVotes: 3, Winner: "cat", Labels: map[string]int{"cat": 1, "dog": 1, "bird": 1}},
+		{Key: "unvoted", Labels: map[string]int{}},
+		{Key: "flagged", Vote: 3, TotalVotes: 3, Winner: "cat", Labels: map[string]int{"cat": 3}, Flagged: true},
+	}
+	selected, flagged := SelectWinners(resources, 0.6)
+	if len(selected) != 1 || selected[0].Key != "agreed" {
+		t.Errorf("Expected only the resource agreed on to be selected, whatever its score, got %v", selected)
+	}
+	if len(flagged) != 1 || flagged[0].Key != "flagged" {
+		t.Errorf("Expected the flagged resource to be listed apart, got %v", flagged)
+	}
+}
+
+func TestJob(t *testing.T) {
+	os.RemoveAll(testDir)
+	defer os.RemoveAll(testDir)
+	var files []File
+	for i := 0; i < 20; i++ {
+		source := filepath.Join(testDir, "source", strconv.Itoa(i)+".jpg")
+		os.MkdirAll(filepath.Dir(source), os.ModePerm)
+		err := ioutil.WriteFile(source, []byte(strconv.Itoa(i)), os.ModePerm)
+		if err != nil {
+			t.Errorf("Unable to create test file")
+			t.FailNow()
+		}
+		files = append(files, File{Source: source, Destination: filepath.Join(testDir, "export", source)})
+	}
+	files = append(files, File{Source: filepath.Join(testDir, "missing.jpg"), Destination: filepath.Join(testDir, "export", "missing.jpg")})
+	manager := NewManager(3)
+	job, err := manager.Start("", filepath.Join(testDir, "export"), ModeCopy, files, map[string]interface{}{"labels.json": []string{}})
+	if err != nil {
+		t.Errorf("Unable to Start Job")
+		t.FailNow()
+	}
+	job = waitJob(t, manager, job.ID)
+	if job.Status != StatusDone || job.Total != 21 || job.Copied != 20 || job.Failed != 1 || len(job.Errors) != 1 || len(job.Manifest) != 20 {
+		t.Errorf("Unexpected Job status: %+v", job)
+	}
+	content, err := ioutil.ReadFile(files[7].Destination)
+	if err != nil || string(content) != "7" {
+		t.Errorf("File was not copied")
+	}
+	for _, name := range []string{"labels.json", "manifest.json"} {
+		if _, err := os.Stat(filepath.Join(testDir, "export", name)); os.IsNotExist(err) {
+			t.Errorf("Expected %s inside the export folder", name)
+		}
+	}
+	if len(manager.List()) != 1 {
+		t.Errorf("Expected one Job to be listed")
+	}
+	if _, err := manager.Get("unknown"); err != ErrJobNotFound {
+		t.Errorf("Unknown jobs should return ErrJobNotFound")
+	}
+	if _, err := manager.Start("", filepath.Join(testDir, "export"), ModeCopy, nil, nil); err != ErrDestinationExists {
+		t.Errorf("Expected ErrDestinationExists when reusing an export folder, got %v", err)
+	}
+	if len(manager.List()) != 1 {
+		t.Errorf("Expected the refused Job not to be listed")
+	}
+}
+
+func TestCancelJob(t *testing.T) {
+	os.RemoveAll(testDir)
+	defer os.RemoveAll(testDir)
+	var files []File
+	for i := 0; i < 1000; i++ {
+		files = append(files, File{Source: filepath.Join(testDir, "missing.jpg"), Destination: filepath.Join(testDir, "export", strconv.Itoa(i))})
+	}
+	manager := NewManager(1)
+	job, err := manager.Start("", filepath.Join(testDir, "export"), ModeCopy, files, nil)
+	if err != nil {
+		t.Errorf("Unable to Start Job")
+		t.FailNow()
+	}
+	err = manager.Cancel(job.ID)
+	if err != nil {
+		t.Errorf("Unable to Cancel Job")
+	}
+	job = waitJob(t, manager, job.ID)
+	if job.Status != StatusCancelled || job.Failed == job.Total {
+		t.Errorf("Job should stop before processing every file: %+v", job)
+	}
+	if err = manager.Cancel(job.ID); err != ErrJobFinished {
+		t.Errorf("Expected ErrJobFinished when cancelling a finished job, got %v", err)
+	}
+}
+
+func TestManifestFailure(t *testing.T) {
+	os.RemoveAll(testDir)
+	defer os.RemoveAll(testDir)
+	manager := NewManager(1)
+	// a folder named manifest.json keeps the final manifest from being written
+	job, err := manager.Start("", filepath.Join(testDir, "export"), ModeCopy, nil, map[string]interface{}{"manifest.json/labels.json": []string{}})
+	if err != nil {
+		t.Errorf("Unable to Start Job")
+		t.FailNow()
+	}
+	job = waitJob(t, manager, job.ID)
+	if job.Status != StatusFailed || len(job.Errors) != 1 {
+		t.Errorf("Expected the Job to fail without its manifest, got %+v", job)
+	}
+}
+
+func TestRetainJobs(t *testing.T) {
+	os.RemoveAll(testDir)
+	defer os.RemoveAll(testDir)
+	manager := NewManager(1)
+	manager.Retain = 2
+	var ids []string
+	for i := 0; i < 3; i++ {
+		job, err := manager.Start("", filepath.Join(testDir, strconv.Itoa(i)), ModeCopy, nil, nil)
+		if err != nil {
+			t.Errorf("Unable to Start Job")
+			t.FailNow()
+		}
+		waitJob(t, manager, job.ID)
+		ids = append(ids, job.ID)
+	}
+	// older jobs are forgotten shortly after the last one is seen finished, so the list is polled
+	for i := 0; i < 100 && len(manager.List()) > 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := manager.Get(ids[0]); err != ErrJobNotFound || len(manager.List()) != 2 {
+		t.Errorf("Expected the first job to be forgotten, got %d jobs", len(manager.List()))
+	}
+	if _, err := manager.Get(ids[2]); err != nil {
+		t.Errorf("Expected the last job to be kept")
+	}
+}
+
+func TestSplit(t *testing.T) {
+	var resources []db.Resource
+	for i := 0; i < 200; i++ {
+		winner := "cat"
+		if i%5 == 0 {
+			winner = "dog"
+		}
+		resources = append(resources, db.Resource{Key: strconv.Itoa(i), Winner: winner})
+	}
+	_, err := ParseRatios("0.8,0.2")
+	if err == nil {
+		t.Errorf("Split without test ratio should fail")
+	}
+	ratios, err := ParseRatios("8,1,1")
+	if err != nil || ratios[0] != 0.8 || ratios[1] != 0.1 || ratios[2] != 0.1 {
+		t.Errorf("Unable to Parse Ratios: %v", ratios)
+	}
+	splits := Split(resources, ratios, 42, false)
+	if len(splits["train"]) != 160 || len(splits["val"]) != 20 || len(splits["test"]) != 20 {
+		t.Errorf("Unexpected split sizes %d %d %d", len(splits["train"]), len(splits["val"]), len(splits["test"]))
+	}
+	// the split must not depend on the order the resources are read in
+	reversed := make([]db.Resource, len(resources))
+	for i, item := range resources {
+		reversed[len(resources)-1-i] = item
+	}
+	again := Split(reversed, ratios, 42, false)
+	for _, split := range SplitNames {
+		for i := range splits[split] {
+			if splits[split][i].Key != again[split][i].Key {
+				t.Errorf("Same seed should produce the same %s split", split)
+				break
+			}
+		}
+	}
+	stratified := Split(resources, ratios, 42, true)
+	for _, split := range SplitNames {
+		dogs := 0
+		for _, item := range stratified[split] {
+			if item.Winner == "dog" {
+				dogs++
+			}
+		}
+		if dogs*5 != len(stratified[split]) {
+			t.Errorf("Stratified %s split should keep a fifth of dogs, got %d out of %d", split, dogs, len(stratified[split]))
+		}
+	}
+	files := Files("out", stratified, nil)
+	if len(files) != 200 || files[0].Split != "train" || files[0].Destination != filepath.Join("out", "train", files[0].Source) {
+		t.Errorf("Unexpected split files: %+v", files[0])
+	}
+}
+
+func TestClassLayouts(t *testing.T) {
+	resources := []db.Resource{
+		{Key: "yes", Vote: 4, TotalVotes: 4, Labels: map[string]int{"true": 4}, Winner: "true"},
+		{Key: "no", Vote: -3, TotalVotes: 5, Labels: map[string]int{"true": 1, "false": 4}, Winner: "false"},
+		{Key: "maybe", Vote: 1, TotalVotes: 3, Labels: map[string]int{"true": 2, "false": 1}, Winner: "true"},
+		{Key: "unvoted", Labels: map[string]int{}},
+	}
+	binary := BinaryClassifier(0.5, -0.5)
+	expected := map[string]string{"yes": Positive, "no": Negative, "maybe": Undecided, "unvoted": Undecided}
+	for _, item := range resources {
+		if binary(item) != expected[item.Key] {
+			t.Errorf("Expected %s in the %s folder, got %s", item.Key, expected[item.Key], binary(item))
+		}
+	}
+	labels := LabelClassifier(0.6)
+	expected = map[string]string{"yes": "true", "no": "false", "maybe": "true", "unvoted": Undecided}
+	for _, item := range resources {
+		if labels(item) != expected[item.Key] {
+			t.Errorf("Expected %s in the %s folder, got %s", item.Key, expected[item.Key], labels(item))
+		}
+	}
+	files := Files("out", map[string][]db.Resource{"": resources}, binary)
+	if len(files) != 4 || files[0].Destination != filepath.Join("out", Positive, "yes") {
+		t.Errorf("Unexpected class files: %+v", files[0])
+	}
+	manifest := ClassManifest(files)
+	if len(manifest[Undecided]) != 2 || len(manifest[Positive]) != 1 || len(manifest[Negative]) != 1 {
+		t.Errorf("Unexpected class manifest: %v", manifest)
+	}
+}
+
+func TestArchive(t *testing.T) {
+	os.RemoveAll(testDir)
+	defer os.RemoveAll(testDir)
+	source := filepath.Join(testDir, "dog.jpg")
+	os.MkdirAll(testDir, os.ModePerm)
+	err := ioutil.WriteFile(source, []byte("woof"), os.ModePerm)
+	if err != nil {
+		t.Errorf("Unable to create test file")
+		t.FailNow()
+	}
+	files := []File{
+		{Source: source, Destination: filepath.Join("train", "dog.jpg")},
+		{Source: filepath.Join(testDir, "missing.jpg"), Destination: "missing.jpg"},
+	}
+	manifests := map[string]interface{}{"labels.json": []string{}, "Annotations/dog.xml": []byte("<annotation/>")}
+	for _, format := range []string{FormatZip, FormatTarGz} {
+		var buffer bytes.Buffer
+		err = WriteArchive(context.Background(), &buffer, format, files, manifests)
+		if err != nil {
+			t.Errorf("Unable to write %s archive: %s", format, err.Error())
+			continue
+		}
+		entries := map[string]string{}
+		if format == FormatZip {
+			reader, err := zip.NewReader(bytes.NewReader(buffer.Bytes()), int64(buffer.Len()))
+			if err != nil {
+				t.Errorf("Unable to read zip archive")
+				continue
+			}
+			for _, file := range reader.File {
+				entry, _ := file.Open()
+				content, _ := ioutil.ReadAll(entry)
+				entry.Close()
+				entries[file.Name] = string(content)
+			}
+		} else {
+			compressed, err := gzip.NewReader(&buffer)
+			if err != nil {
+				t.Errorf("Unable to read tar.gz archive")
+				continue
+			}
+			reader := tar.NewReader(compressed)
+			for {
+				header, err := reader.Next()
+				if err == io.EOF {
+					break
+				} else if err != nil {
+					t.Errorf("Unable to read tar.gz archive")
+					break
+				}
+				content, _ := ioutil.ReadAll(reader)
+				entries[header.Name] = string(content)
+			}
+		}
+		if entries["train/dog.jpg"] != "woof" {
+			t.Errorf("Expected the picture inside the %s archive, got %v", format, entries)
+		}
+		if _, ok := entries["labels.json"]; !ok {
+			t.Errorf("Expected labels.json inside the %s archive", format)
+		}
+		if entries["Annotations/dog.xml"] != "<annotation/>" {
+			t.Errorf("Expected encoded manifests to be archived as they are, got %q", entries["Annotations/dog.xml"])
+		}
+		if !bytes.Contains([]byte(entries["manifest.json"]), []byte("missing.jpg")) {
+			t.Errorf("Expected the missing picture to be reported in the %s manifest", format)
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := WriteArchive(ctx, ioutil.Discard, FormatZip, files, manifests); err != context.Canceled {
+		t.Errorf("Expected a cancelled archive to stop")
+	}
+	if err := WriteArchive(context.Background(), ioutil.Discard, "rar", files, manifests); err != ErrUnknownFormat {
+		t.Errorf("Expected unknown formats to be refused")
+	}
+	// a folder opens like a picture, but fails once its entry is started
+	unreadable := append(files, File{Source: testDir, Destination: "folder.jpg"})
+	for _, format := range []string{FormatZip, FormatTarGz} {
+		if err := WriteArchive(context.Background(), ioutil.Discard, format, unreadable, manifests); err == nil {
+			t.Errorf("Expected a picture failing inside its %s entry to stop the archive", format)
+		}
+	}
+}
+
+func TestLabelEncoder(t *testing.T) {
+	resource := db.Resource{Key: "./static/dog.jpg", Vote: 1, TotalVotes: 3, Labels: map[string]int{"true": 2, "false": 1}, Winner: "true"}
+	votes := []db.VoteRecord{{Annotator: "bob", Label: "false"}, {Annotator: "alice", Label: "true"}, {Annotator: "carol", Label: "true"}}
+	row := NewLabelRow(resource, votes)
+	if row.Path != "static/dog.jpg" || row.Annotators["bob"] != "false" || row.Ratio < 0.33 || row.Ratio > 0.34 {
+		t.Errorf("Unexpected label row: %+v", row)
+	}
+	var buffer bytes.Buffer
+	encoder, err := NewLabelEncoder(&buffer, FormatCSV, []string{"true", "false"})
+	if err != nil {
+		t.Errorf("Unable to create CSV encoder")
+		t.FailNow()
+	}
+	encoder.Encode(row)
+	encoder.Flush()
+	records, err := csv.NewReader(&buffer).ReadAll()
+	if err != nil || len(records) != 2 {
+		t.Errorf("Expected a header and a row, got %v", records)
+		t.FailNow()
+	}
+	if strings.Join(records[0], ",") != "key,path,score,total_votes,ratio,votes_true,votes_false,annotators,finalized,label" {
+		t.Errorf("Unexpected CSV header: %v", records[0])
+	}
+	if records[1][5] != "2" || records[1][7] != "alice=true;bob=false;carol=true" || records[1][9] != "true" {
+		t.Errorf("Unexpected CSV row: %v", records[1])
+	}
+	buffer.Reset()
+	encoder, _ = NewLabelEncoder(&buffer, FormatJSONL, nil)
+	encoder.Encode(row)
+	encoder.Encode(row)
+	lines := strings.Split(strings.TrimSpace(buffer.String()), "\n")
+	var decoded LabelRow
+	if len(lines) != 2 || json.Unmarshal([]byte(lines[1]), &decoded) != nil || decoded.Label != "true" {
+		t.Errorf("Expected one JSON object per line, got %v", lines)
+	}
+	if _, err := NewLabelEncoder(&buffer, "xml", nil); err != ErrUnknownFormat {
+		t.Errorf("Expected unknown formats to be refused")
+	}
+}
+
+func TestFilter(t *testing.T) {
+	taken := time.Date(2018, 6, 30, 12, 0, 0, 0, time.UTC)
+	resources := []db.Resource{
+		{Key: "wide.jpg", Metadata: &db.Metadata{Width: 400, Height: 200, Format: "jpeg", Size: 5000, Taken: &taken}},
+		{Key: "square.png", Metadata: &db.Metadata{Width: 100, Height: 100, Format: "png", Size: 800}},
+		{Key: "unknown.jpg"},
+	}
+	cases := []struct {
+		query string
+		keys  []string
+	}{
+		{"", []string{"wide.jpg", "square.png", "unknown.jpg"}},
+		{"min_width=200", []string{"wide.jpg"}},
+		{"max_aspect=1.5", []string{"square.png"}},
+		{"min_size=1000&image_format=jpeg,png", []string{"wide.jpg"}},
+		{"image_format=png", []string{"square.png"}},
+		{"format=csv", []string{"wide.jpg", "square.png", "unknown.jpg"}},
+		{"taken_after=2018-06-01&taken_before=2018-07-01T00:00:00Z", []string{"wide.jpg"}},
+		{"taken_before=2018-06-01", []string{}},
+	}
+	for _, c := range cases {
+		query, _ := url.ParseQuery(c.query)
+		filter, err := ParseFilter(query)
+		if err != nil {
+			t.Errorf("Unable to parse %s: %s", c.query, err.Error())
+			continue
+		}
+		kept := filter.Filter(resources)
+		keys := []string{}
+		for _, resource := range kept {
+			keys = append(keys, resource.Key)
+		}
+		if strings.Join(keys, ",") != strings.Join(c.keys, ",") {
+			t.Errorf("Filter %s kept %v, expected %v", c.query, keys, c.keys)
+		}
+	}
+	for _, query := range []string{"min_width=wide", "max_size=-1", "taken_after=yesterday"} {
+		values, _ := url.ParseQuery(query)
+		if _, err := ParseFilter(values); err == nil {
+			t.Errorf("Expected %s to be refused", query)
+		}
+	}
+}
+
+func TestImageFolderMetadata(t *testing.T) {
+	resources := []db.Resource{
+		{Key: "./static/cat.jpg", Vote: 2, TotalVotes: 4, Labels: map[string]int{"cat": 3, "dog": 1}, Winner: "cat"},
+		{Key: "./static/dog.jpg", Vote: -2, TotalVotes: 2, Labels: map[string]int{"dog": 2}, Winner: "dog"},
+	}
+	files := Files("out", map[string][]db.Resource{"train": resources[:1], "val": resources[1:]}, LabelClassifier(0.5))
+	metadata, err := ImageFolderMetadata("out", files)
+	if err != nil || len(metadata) != 2 {
+		t.Errorf("Expected one metadata file per split, got %v", metadata)
+		t.FailNow()
+	}
+	var row ImageFolderRow
+	err = json.Unmarshal(metadata["train/metadata.jsonl"], &row)
+	if err != nil || row.FileName != "cat/static/cat.jpg" || row.Label != "cat" || row.Score != 2 || row.Agreement != 0.75 {
+		t.Errorf("Unexpected metadata row: %+v", row)
+	}
+	metadata, _ = ImageFolderMetadata("out", Files("out", map[string][]db.Resource{"": resources}, nil))
+	lines := strings.Split(strings.TrimSpace(string(metadata["metadata.jsonl"])), "\n")
+	if len(metadata) != 1 || len(lines) != 2 {
+		t.Errorf("Expected a single metadata file with a line per picture, got %v", metadata)
+	}
+}
+
+func TestModes(t *testing.T) {
+	os.RemoveAll(testDir)
+	defer os.RemoveAll(testDir)
+	source := filepath.Join(testDir, "source", "dog.jpg")
+	os.MkdirAll(filepath.Dir(source), os.ModePerm)
+	err := ioutil.WriteFile(source, []byte("woof"), os.ModePerm)
+	if err != nil {
+		t.Errorf("Unable to create test file")
+		t.FailNow()
+	}
+	manager := NewManager(2)
+	for _, mode := range []string{ModeCopy, ModeHardlink, ModeSymlink} {
+		destination := filepath.Join(testDir, mode)
+		files := []File{
+			{Source: source, Destination: filepath.Join(destination, "dog.jpg")},
+			{Source: filepath.Join(testDir, "missing.jpg"), Destination: filepath.Join(destination, "missing.jpg")},
+		}
+		job, err := manager.Start("", destination, mode, files, nil)
+		if err != nil {
+			t.Errorf("Unable to Start %s Job", mode)
+			continue
+		}
+		job = waitJob(t, manager, job.ID)
+		if job.Mode != mode || job.Copied != 1 || job.Failed != 1 || len(job.Errors) != 1 {
+			t.Errorf("Unexpected %s Job status: %+v", mode, job)
+		}
+		content, err := ioutil.ReadFile(files[0].Destination)
+		if err != nil || string(content) != "woof" {
+			t.Errorf("Picture was not placed by the %s mode", mode)
+		}
+		info, err := os.Lstat(files[0].Destination)
+		if err == nil && (info.Mode()&os.ModeSymlink != 0) != (mode == ModeSymlink) {
+			t.Errorf("Only the symlink mode should create symbolic links")
+		}
+		if _, err := os.Lstat(files[1].Destination); !os.IsNotExist(err) {
+			t.Errorf("Missing pictures should not be placed by the %s mode", mode)
+		}
+	}
+	if _, err := manager.Start("", filepath.Join(testDir, "unknown"), "move", nil, nil); err != ErrUnknownMode {
+		t.Errorf("Expected unknown modes to be refused")
+	}
+}
@@ -0,0 +1,156 @@
+package export
+
+import (
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/auyer/colab-dataset/db"
+)
+
+// dateLayouts are the layouts accepted for the dates of a filter.
+var dateLayouts = []string{time.RFC3339, "2006-01-02"}
+
+// Filter keeps the resources whose metadata falls inside its bounds. Zero bounds are not checked,
+// and resources without metadata are only kept by filters without any bound.
+type Filter struct {
+	MinWidth, MaxWidth   int
+	MinHeight, MaxHeight int
+	MinAspect, MaxAspect float64
+	MinSize, MaxSize     int64
+	Formats              []string
+	TakenAfter           time.Time
+	TakenBefore          time.Time
+	ModifiedAfter        time.Time
+	ModifiedBefore       time.Time
+}
+
+// ParseFilter reads a filter from query parameters: min_width, max_width, min_height, max_height, min_aspect, max_aspect,
+// min_size and max_size in bytes, image_format as a comma separated list, and taken_after, taken_before, modified_after
+// and modified_before as RFC 3339 dates or days such as 2018-06-30.
+func ParseFilter(query url.Values) (filter Filter, err error) {
+	integers := map[string]*int{"min_width": &filter.MinWidth, "max_width": &filter.MaxWidth, "min_height": &filter.MinHeight, "max_height": &filter.MaxHeight}
+	for name, bound := range integers {
+		if query.Get(name) != "" {
+			*bound, err = strconv.Atoi(query.Get(name))
+			if err != nil || *bound < 0 {
+				return filter, errors.New("Invalid " + name + " " + query.Get(name))
+			}
+		}
+	}
+	sizes := map[string]*int64{"min_size": &filter.MinSize, "max_size": &filter.MaxSize}
+	for name, bound := range sizes {
+		if query.Get(name) != "" {
+			*bound, err = strconv.ParseInt(query.Get(name), 10, 64)
+			if err != nil || *bound < 0 {
+				return filter, errors.New("Invalid " + name + " " + query.Get(name))
+			}
+		}
+	}
+	ratios := map[string]*float64{"min_aspect": &filter.MinAspect, "max_aspect": &filter.MaxAspect}
+	for name, bound := range ratios {
+		if query.Get(name) != "" {
+			*bound, err = strconv.ParseFloat(query.Get(name), 64)
+			if err != nil || *bound < 0 {
+				return filter, errors.New("Invalid " + name + " " + query.Get(name))
+			}
+		}
+	}
+	dates := map[string]*time.Time{"taken_after": &filter.TakenAfter, "taken_before": &filter.TakenBefore, "modified_after": &filter.ModifiedAfter, "modified_before": &filter.ModifiedBefore}
+	for name, bound := range dates {
+		if query.Get(name) != "" {
+			*bound, err = parseDate(query.Get(name))
+			if err != nil {
+				return filter, errors.New("Invalid " + name + " " + query.Get(name))
+			}
+		}
+	}
+	if query.Get("image_format") != "" {
+		filter.Formats = strings.Split(query.Get("image_format"), ",")
+	}
+	return filter, nil
+}
+
+// parseDate reads a date in one of the dateLayouts.
+func parseDate(text string) (date time.Time, err error) {
+	for _, layout := range dateLayouts {
+		date, err = time.Parse(layout, text)
+		if err == nil {
+			return date, nil
+		}
+	}
+	return date, err
+}
+
+// Empty reports whether the filter keeps every resource.
+func (f Filter) Empty() bool {
+	return f.MinWidth == 0 && f.MaxWidth == 0 && f.MinHeight == 0 && f.MaxHeight == 0 &&
+		f.MinAspect == 0 && f.MaxAspect == 0 && f.MinSize == 0 && f.MaxSize == 0 && len(f.Formats) == 0 &&
+		f.TakenAfter.IsZero() && f.TakenBefore.IsZero() && f.ModifiedAfter.IsZero() && f.ModifiedBefore.IsZero()
+}
+
+// Match reports whether the resource is kept by the filter.
+// Pictures without a capture date are discarded by the taken bounds, and files of unknown dimensions by the width, height and aspect bounds.
+func (f Filter) Match(resource db.Resource) bool {
+	if f.Empty() {
+		return true
+	}
+	m := resource.Metadata
+	if m == nil {
+		return false
+	}
+	if (f.MinWidth > 0 && m.Width < f.MinWidth) || (f.MaxWidth > 0 && (m.Width == 0 || m.Width > f.MaxWidth)) {
+		return false
+	}
+	if (f.MinHeight > 0 && m.Height < f.MinHeight) || (f.MaxHeight > 0 && (m.Height == 0 || m.Height > f.MaxHeight)) {
+		return false
+	}
+	if (f.MinAspect > 0 && m.Aspect() < f.MinAspect) || (f.MaxAspect > 0 && (m.Aspect() == 0 || m.Aspect() > f.MaxAspect)) {
+		return false
+	}
+	if (f.MinSize > 0 && m.Size < f.MinSize) || (f.MaxSize > 0 && m.Size > f.MaxSize) {
+		return false
+	}
+	if len(f.Formats) > 0 && !contains(f.Formats, m.Format) {
+		return false
+	}
+	if !f.TakenAfter.IsZero() && (m.Taken == nil || m.Taken.Before(f.TakenAfter)) {
+		return false
+	}
+	if !f.TakenBefore.IsZero() && (m.Taken == nil || !m.Taken.Before(f.TakenBefore)) {
+		return false
+	}
+	if !f.ModifiedAfter.IsZero() && m.Modified.Before(f.ModifiedAfter) {
+		return false
+	}
+	if !f.ModifiedBefore.IsZero() && !m.Modified.Before(f.ModifiedBefore) {
+		return false
+	}
+	return true
+}
+
+// Filter returns the resources kept by the filter, in the same order.
+func (f Filter) Filter(resources []db.Resource) []db.Resource {
+	if f.Empty() {
+		return resources
+	}
+	kept := []db.Resource{}
+	for _, resource := range resources {
+		if f.Match(resource) {
+			kept = append(kept, resource)
+		}
+	}
+	return kept
+}
+
+// contains reports whether value is one of values.
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
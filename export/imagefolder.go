@@ -0,0 +1,51 @@
+package export
+
+import (
+	"bytes"
+	"encoding/json"
+	"path/filepath"
+)
+
+// ImageFolderRow is the line of metadata.jsonl describing a single picture of an imagefolder dataset.
+// FileName is relative to the metadata file, and Agreement is the share of the votes received by the winning label.
+type ImageFolderRow struct {
+	FileName   string  `json:"file_name"`
+	Label      string  `json:"label"`
+	Score      int     `json:"score"`
+	TotalVotes int     `json:"total_votes"`
+	Agreement  float64 `json:"agreement"`
+}
+
+// ImageFolderMetadata returns the metadata.jsonl files of an export into destination, following the Hugging Face imagefolder layout.
+// Each split folder gets its own file, or a single one is placed at the root when the export is not split.
+// Pictures are labeled with their class folder, or with their winning label when the export has no class layout.
+func ImageFolderMetadata(destination string, files []File) (map[string][]byte, error) {
+	contents := map[string]*bytes.Buffer{}
+	for _, file := range files {
+		row := ImageFolderRow{Label: file.Resource.Winner, Score: file.Resource.Vote, TotalVotes: file.Resource.TotalVotes}
+		if file.Class != "" {
+			row.Label = file.Class
+		}
+		if file.Resource.TotalVotes > 0 && file.Resource.Winner != "" {
+			row.Agreement = float64(file.Resource.Labels[file.Resource.Winner]) / float64(file.Resource.TotalVotes)
+		}
+		fileName, err := filepath.Rel(filepath.Join(destination, file.Split), file.Destination)
+		if err != nil {
+			return nil, err
+		}
+		row.FileName = filepath.ToSlash(fileName)
+		name := filepath.ToSlash(filepath.Join(file.Split, "metadata.jsonl"))
+		if contents[name] == nil {
+			contents[name] = &bytes.Buffer{}
+		}
+		err = json.NewEncoder(contents[name]).Encode(row)
+		if err != nil {
+			return nil, err
+		}
+	}
+	metadata := map[string][]byte{}
+	for name, content := range contents {
+		metadata[name] = content.Bytes()
+	}
+	return metadata, nil
+}
@@ -0,0 +1,305 @@
+package export
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/auyer/colab-dataset/db"
+)
+
+// Job status values.
+const (
+	StatusRunning   = "running"
+	StatusDone      = "done"
+	StatusCancelled = "cancelled"
+	// StatusFailed is reported when the files were placed, but manifest.json could not be written.
+	StatusFailed = "failed"
+)
+
+// DefaultRetain is the amount of finished jobs a new Manager keeps.
+const DefaultRetain = 100
+
+var (
+	// ErrJobNotFound is returned when looking for a job ID the Manager does not know.
+	ErrJobNotFound = errors.New("Export job not found")
+	// ErrJobFinished is returned when cancelling a job that is no longer running.
+	ErrJobFinished = errors.New("Export job already finished")
+	// ErrDestinationExists is returned when starting a job into a folder that already exists.
+	ErrDestinationExists = errors.New("Export destination already exists")
+)
+
+// File is a single copy performed by a job, from the voted picture to its place inside the export folder.
+// Split names the train, validation or test folder the file belongs to, when the export is split,
+// and Class names its class folder, when the export uses a class layout.
+type File struct {
+	Source      string      `json:"Source"`
+	Destination string      `json:"Destination"`
+	Split       string      `json:"Split,omitempty"`
+	Class       string      `json:"Class,omitempty"`
+	Resource    db.Resource `json:"Resource"`
+}
+
+// Job structure reports the progress of an export. Mode is the export mode placing the pictures, and Manifest lists the files copied so far.
+type Job struct {
+	ID          string    `json:"ID"`
+	Status      string    `json:"Status"`
+	Destination string    `json:"Destination"`
+	Mode        string    `json:"Mode"`
+	Total       int       `json:"Total"`
+	Copied      int       `json:"Copied"`
+	Failed      int       `json:"Failed"`
+	Errors      []string  `json:"Errors"`
+	Manifest    []File    `json:"Manifest"`
+	Started     time.Time `json:"Started"`
+	Finished    time.Time `json:"Finished"`
+}
+
+// job is the state a Manager keeps for every Job.
+type job struct {
+	mutex  sync.Mutex
+	status Job
+	cancel context.CancelFunc
+}
+
+// Manager runs export jobs in the background and keeps their status.
+type Manager struct {
+	// Workers is the amount of files each job copies at the same time.
+	Workers int
+	// Retain is the amount of finished jobs kept. When a job ends, the ones that finished first are forgotten beyond it.
+	Retain int
+	mutex  sync.Mutex
+	jobs   map[string]*job
+}
+
+// NewManager creates a Manager whose jobs copy up to workers files at the same time, keeping DefaultRetain finished jobs.
+func NewManager(workers int) *Manager {
+	if workers < 1 {
+		workers = 1
+	}
+	return &Manager{Workers: workers, Retain: DefaultRetain, jobs: map[string]*job{}}
+}
+
+// Start creates a job placing files into destination with the export mode, writing the provided manifests next to them, and returns its initial status.
+// id identifies the job, and is picked with NewID when empty, so callers can name destination after it.
+// destination must not exist yet, so two jobs never share a folder, and fails with ErrDestinationExists otherwise.
+// manifests maps file names to the values written inside destination before the copy begins, as JSON unless they are already encoded as []byte.
+// Once the job ends, its final status is written to manifest.json inside destination.
+func (m *Manager) Start(id string, destination string, mode string, files []File, manifests map[string]interface{}) (Job, error) {
+	if !ValidMode(mode) {
+		return Job{}, ErrUnknownMode
+	}
+	var err error
+	if id == "" {
+		id, err = NewID()
+		if err != nil {
+			return Job{}, err
+		}
+	}
+	err = os.MkdirAll(filepath.Dir(destination), os.ModePerm)
+	if err != nil {
+		return Job{}, err
+	}
+	err = os.Mkdir(destination, os.ModePerm)
+	if os.IsExist(err) {
+		return Job{}, ErrDestinationExists
+	} else if err != nil {
+		return Job{}, err
+	}
+	for name, value := range manifests {
+		err = writeManifest(filepath.Join(destination, name), value)
+		if err != nil {
+			return Job{}, err
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	j := &job{
+		status: Job{
+			ID:          id,
+			Status:      StatusRunning,
+			Destination: destination,
+			Mode:        mode,
+			Total:       len(files),
+			Errors:      []string{},
+			Manifest:    []File{},
+			Started:     time.Now(),
+		},
+		cancel: cancel,
+	}
+	m.mutex.Lock()
+	m.jobs[id] = j
+	m.mutex.Unlock()
+	go m.run(ctx, j, files)
+	return j.snapshot(), nil
+}
+
+// run places every file with a pool of m.Workers goroutines, stopping early if ctx is cancelled.
+func (m *Manager) run(ctx context.Context, j *job, files []File) {
+	transfer := transfers[j.status.Mode]
+	tasks := make(chan File)
+	var wg sync.WaitGroup
+	for w := 0; w < m.Workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for file := range tasks {
+				j.record(file, transfer(file.Source, file.Destination))
+			}
+		}()
+	}
+	cancelled := false
+feed:
+	for _, file := range files {
+		select {
+		case <-ctx.Done():
+			cancelled = true
+			break feed
+		case tasks <- file:
+		}
+	}
+	close(tasks)
+	wg.Wait()
+	// manifest.json is written before the final status is published, so a finished job always has one
+	final := j.snapshot()
+	final.Status = StatusDone
+	if cancelled {
+		final.Status = StatusCancelled
+	}
+	final.Finished = time.Now()
+	err := writeManifest(filepath.Join(final.Destination, "manifest.json"), final)
+	j.mutex.Lock()
+	j.status.Status = final.Status
+	j.status.Finished = final.Finished
+	if err != nil {
+		j.status.Status = StatusFailed
+		j.status.Errors = append(j.status.Errors, "manifest.json: "+err.Error())
+	}
+	j.mutex.Unlock()
+	j.cancel()
+	m.forget()
+}
+
+// forget drops the jobs that finished first, beyond the m.Retain most recent ones. Their manifest.json files are kept.
+func (m *Manager) forget() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	var finished []Job
+	for _, j := range m.jobs {
+		j.mutex.Lock()
+		if j.status.Status != StatusRunning {
+			finished = append(finished, Job{ID: j.status.ID, Finished: j.status.Finished})
+		}
+		j.mutex.Unlock()
+	}
+	if len(finished) <= m.Retain {
+		return
+	}
+	sort.Slice(finished, func(a, b int) bool { return finished[a].Finished.Before(finished[b].Finished) })
+	for _, status := range finished[:len(finished)-m.Retain] {
+		delete(m.jobs, status.ID)
+	}
+}
+
+// record updates the job counters with the result of placing file.
+func (j *job) record(file File, err error) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	if err != nil {
+		j.status.Failed++
+		j.status.Errors = append(j.status.Errors, file.Source+": "+err.Error())
+		return
+	}
+	j.status.Copied++
+	j.status.Manifest = append(j.status.Manifest, file)
+}
+
+// snapshot returns a copy of the job status that is safe to read while the job runs.
+func (j *job) snapshot() Job {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	status := j.status
+	status.Errors = append([]string{}, j.status.Errors...)
+	status.Manifest = append([]File{}, j.status.Manifest...)
+	return status
+}
+
+// Get returns the status of a job.
+func (m *Manager) Get(id string) (Job, error) {
+	m.mutex.Lock()
+	j, ok := m.jobs[id]
+	m.mutex.Unlock()
+	if !ok {
+		return Job{}, ErrJobNotFound
+	}
+	return j.snapshot(), nil
+}
+
+// List returns the status of every job, without their manifests.
+func (m *Manager) List() []Job {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	list := []Job{}
+	for _, j := range m.jobs {
+		status := j.snapshot()
+		status.Manifest = nil
+		list = append(list, status)
+	}
+	return list
+}
+
+// Cancel stops a running job. Files already copied are kept. It fails with ErrJobFinished when the job is no longer running.
+func (m *Manager) Cancel(id string) error {
+	m.mutex.Lock()
+	j, ok := m.jobs[id]
+	m.mutex.Unlock()
+	if !ok {
+		return ErrJobNotFound
+	}
+	j.mutex.Lock()
+	running := j.status.Status == StatusRunning
+	j.mutex.Unlock()
+	if !running {
+		return ErrJobFinished
+	}
+	j.cancel()
+	return nil
+}
+
+// NewID returns a random job identifier.
+func NewID() (string, error) {
+	id := make([]byte, 8)
+	_, err := rand.Read(id)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// encodeManifest returns the content of a manifest file, encoding value as indented JSON unless it is already a []byte.
+func encodeManifest(value interface{}) ([]byte, error) {
+	if content, ok := value.([]byte); ok {
+		return content, nil
+	}
+	return json.MarshalIndent(value, "", "  ")
+}
+
+// writeManifest writes the content of value to path, creating the folders path needs.
+func writeManifest(path string, value interface{}) error {
+	content, err := encodeManifest(value)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(path), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, content, os.ModePerm)
+}
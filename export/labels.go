@@ -0,0 +1,110 @@
+package export
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/auyer/colab-dataset/db"
+)
+
+// Label file formats written by LabelEncoder.
+const (
+	FormatCSV   = "csv"
+	FormatJSONL = "jsonl"
+)
+
+// LabelRow is the line of the label file describing a single picture.
+// Ratio is its score divided by its amount of votes, Annotators holds the label chosen by each annotator, and Label is its winning label.
+type LabelRow struct {
+	Key        string            `json:"key"`
+	Path       string            `json:"path"`
+	Score      int               `json:"score"`
+	TotalVotes int               `json:"total_votes"`
+	Ratio      float64           `json:"ratio"`
+	Labels     map[string]int    `json:"labels"`
+	Annotators map[string]string `json:"annotators"`
+	Finalized  bool              `json:"finalized"`
+	Label      string            `json:"label"`
+}
+
+// NewLabelRow describes a resource and the votes cast on it.
+func NewLabelRow(resource db.Resource, votes []db.VoteRecord) LabelRow {
+	row := LabelRow{
+		Key:        resource.Key,
+		Path:       filepath.ToSlash(filepath.Clean(resource.Key)),
+		Score:      resource.Vote,
+		TotalVotes: resource.TotalVotes,
+		Labels:     resource.Labels,
+		Annotators: map[string]string{},
+		Finalized:  resource.Finalized,
+		Label:      resource.Winner,
+	}
+	if resource.TotalVotes > 0 {
+		row.Ratio = float64(resource.Vote) / float64(resource.TotalVotes)
+	}
+	for _, vote := range votes {
+		row.Annotators[vote.Annotator] = vote.Label
+	}
+	return row
+}
+
+// LabelEncoder writes label rows one at a time, so a label file can be streamed while the database is read.
+type LabelEncoder struct {
+	format string
+	labels []string
+	csv    *csv.Writer
+	json   *json.Encoder
+}
+
+// NewLabelEncoder creates a LabelEncoder writing format rows to w. CSV files get one count column for each of labels,
+// and their header is written right away.
+func NewLabelEncoder(w io.Writer, format string, labels []string) (*LabelEncoder, error) {
+	encoder := &LabelEncoder{format: format, labels: labels}
+	switch format {
+	case FormatCSV:
+		encoder.csv = csv.NewWriter(w)
+		header := []string{"key", "path", "score", "total_votes", "ratio"}
+		for _, label := range labels {
+			header = append(header, "votes_"+label)
+		}
+		header = append(header, "annotators", "finalized", "label")
+		return encoder, encoder.csv.Write(header)
+	case FormatJSONL:
+		encoder.json = json.NewEncoder(w)
+		return encoder, nil
+	}
+	return nil, ErrUnknownFormat
+}
+
+// Encode writes a row.
+func (e *LabelEncoder) Encode(row LabelRow) error {
+	if e.json != nil {
+		return e.json.Encode(row)
+	}
+	record := []string{row.Key, row.Path, strconv.Itoa(row.Score), strconv.Itoa(row.TotalVotes), strconv.FormatFloat(row.Ratio, 'f', -1, 64)}
+	for _, label := range e.labels {
+		record = append(record, strconv.Itoa(row.Labels[label]))
+	}
+	// annotators are listed as annotator=label pairs, sorted so the file is reproducible
+	annotators := make([]string, 0, len(row.Annotators))
+	for annotator, label := range row.Annotators {
+		annotators = append(annotators, annotator+"="+label)
+	}
+	sort.Strings(annotators)
+	record = append(record, strings.Join(annotators, ";"), strconv.FormatBool(row.Finalized), row.Label)
+	return e.csv.Write(record)
+}
+
+// Flush writes any buffered row to the underlying writer.
+func (e *LabelEncoder) Flush() error {
+	if e.csv != nil {
+		e.csv.Flush()
+		return e.csv.Error()
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package export
+
+import (
+	"errors"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/auyer/colab-dataset/db"
+)
+
+// SplitNames are the folders a split export is divided into, in the order their ratios are given.
+var SplitNames = []string{"train", "val", "test"}
+
+// ParseRatios reads the comma separated train, validation and test ratios, like "0.8,0.1,0.1", normalizing them so they sum to 1.
+func ParseRatios(value string) ([]float64, error) {
+	fields := strings.Split(value, ",")
+	if len(fields) != len(SplitNames) {
+		return nil, errors.New("Split needs train, validation and test ratios")
+	}
+	ratios := make([]float64, len(fields))
+	sum := 0.0
+	for i, field := range fields {
+		ratio, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil {
+			return nil, err
+		}
+		if ratio < 0 {
+			return nil, errors.New("Split ratios can not be negative")
+		}
+		ratios[i] = ratio
+		sum += ratio
+	}
+	if sum == 0 {
+		return nil, errors.New("Split ratios can not all be zero")
+	}
+	for i := range ratios {
+		ratios[i] /= sum
+	}
+	return ratios, nil
+}
+
+// Split divides the resources into the SplitNames according to ratios. The same resources, ratios and seed always produce the same split.
+// When stratify is set, each winning label is divided separately, so every split keeps the label distribution of the whole set.
+func Split(resources []db.Resource, ratios []float64, seed int64, stratify bool) map[string][]db.Resource {
+	groups := map[string][]db.Resource{}
+	for _, item := range resources {
+		group := ""
+		if stratify {
+			group = item.Winner
+		}
+		groups[group] = append(groups[group], item)
+	}
+	// groups and their members are sorted so the shuffle does not depend on the database iteration order
+	var names []string
+	for name := range groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	random := rand.New(rand.NewSource(seed))
+	splits := map[string][]db.Resource{}
+	for _, name := range names {
+		group := groups[name]
+		sort.Slice(group, func(i, j int) bool { return group[i].Key < group[j].Key })
+		for i := len(group) - 1; i > 0; i-- {
+			j := random.Intn(i + 1)
+			group[i], group[j] = group[j], group[i]
+		}
+		start := 0
+		cumulative := 0.0
+		for i, split := range SplitNames {
+			cumulative += ratios[i]
+			end := int(cumulative*float64(len(group)) + 0.5)
+			if i == len(SplitNames)-1 || end > len(group) {
+				end = len(group)
+			}
+			splits[split] = append(splits[split], group[start:end]...)
+			start = end
+		}
+	}
+	return splits
+}
+
+// SplitManifest lists the keys inside each split.
+func SplitManifest(splits map[string][]db.Resource) map[string][]string {
+	manifest := map[string][]string{}
+	for _, split := range SplitNames {
+		manifest[split] = []string{}
+		for _, item := range splits[split] {
+			manifest[split] = append(manifest[split], item.Key)
+		}
+	}
+	return manifest
+}
@@ -0,0 +1,86 @@
+package export
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Export modes, deciding how each picture is placed inside the export folder.
+const (
+	// ModeCopy duplicates every picture.
+	ModeCopy = "copy"
+	// ModeHardlink links every picture to the original file, so no disk space is used while both are on the same file system.
+	ModeHardlink = "hardlink"
+	// ModeSymlink points every picture to the absolute path of the original file.
+	ModeSymlink = "symlink"
+)
+
+// ErrUnknownMode is returned when starting a job with an export mode that is not one of the Mode constants.
+var ErrUnknownMode = errors.New("Unknown export mode")
+
+// transfers maps each export mode to the function placing src at dst.
+var transfers = map[string]func(src, dst string) error{
+	ModeCopy:     copyFile,
+	ModeHardlink: linkFile,
+	ModeSymlink:  symlinkFile,
+}
+
+// ValidMode reports whether mode is one of the export modes.
+func ValidMode(mode string) bool {
+	_, ok := transfers[mode]
+	return ok
+}
+
+// copyFile streams src into dst, creating the folders dst needs. Partial copies are removed.
+func copyFile(src, dst string) error {
+	input, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+	err = os.MkdirAll(filepath.Dir(dst), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	output, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(output, input)
+	if closeErr := output.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(dst)
+	}
+	return err
+}
+
+// linkFile creates dst as a hard link to src, creating the folders dst needs.
+func linkFile(src, dst string) error {
+	err := os.MkdirAll(filepath.Dir(dst), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	return os.Link(src, dst)
+}
+
+// symlinkFile creates dst as a symbolic link to the absolute path of src, creating the folders dst needs.
+// The link is only created when src exists, so missing pictures are reported instead of leaving dangling links.
+func symlinkFile(src, dst string) error {
+	target, err := filepath.Abs(src)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stat(target)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(dst), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	return os.Symlink(target, dst)
+}
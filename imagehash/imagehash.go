@@ -0,0 +1,148 @@
+// Package imagehash computes perceptual hashes of pictures, which stay close when a picture is resized or re-encoded,
+// and groups pictures whose hashes are within a Hamming distance of each other.
+package imagehash
+
+import (
+	"image"
+	// decoders for the picture formats that can be hashed
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"math/bits"
+	"sort"
+	"strconv"
+)
+
+// DefaultDistance is the Hamming distance under which two hashes are usually the same picture.
+const DefaultDistance = 5
+
+// DHash computes the 64 bit difference hash of the picture read from r.
+// The picture is shrunk to 9x8 gray cells, and each bit tells whether a cell is brighter than its right neighbour.
+func DHash(r io.Reader) (uint64, error) {
+	img, _, err := image.Decode(r)
+	if err != nil {
+		return 0, err
+	}
+	const width, height = 9, 8
+	var sums, counts [height][width]uint64
+	bounds := img.Bounds()
+	if bounds.Empty() {
+		return 0, image.ErrFormat
+	}
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		cy := (y - bounds.Min.Y) * height / bounds.Dy()
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			cx := (x - bounds.Min.X) * width / bounds.Dx()
+			r, g, b, _ := img.At(x, y).RGBA()
+			sums[cy][cx] += (299*uint64(r) + 587*uint64(g) + 114*uint64(b)) / 1000
+			counts[cy][cx]++
+		}
+	}
+	// pictures smaller than the grid leave cells without pixels, which take the value of their left neighbour
+	var cells [height][width]uint64
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			if counts[y][x] > 0 {
+				cells[y][x] = sums[y][x] / counts[y][x]
+			} else if x > 0 {
+				cells[y][x] = cells[y][x-1]
+			}
+		}
+	}
+	var hash uint64
+	for y := 0; y < height; y++ {
+		for x := 0; x < width-1; x++ {
+			hash <<= 1
+			if cells[y][x] > cells[y][x+1] {
+				hash |= 1
+			}
+		}
+	}
+	return hash, nil
+}
+
+// Format returns hash as 16 hex digits.
+func Format(hash uint64) string {
+	text := strconv.FormatUint(hash, 16)
+	for len(text) < 16 {
+		text = "0" + text
+	}
+	return text
+}
+
+// Parse reads a hash written by Format.
+func Parse(text string) (uint64, error) {
+	return strconv.ParseUint(text, 16, 64)
+}
+
+// Distance returns the amount of bits that differ between two hashes.
+func Distance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
+
+// Clusters groups the keys whose hashes are within distance of each other, directly or through other keys of the group.
+// Only groups with more than one key are returned, each one sorted, and ordered by their first key.
+//
+// By the pigeonhole principle, two hashes within distance bits agree on at least one of distance+1 disjoint blocks,
+// so only keys sharing a block are compared, instead of every pair. Every pair is compared from a distance of 64 on.
+func Clusters(hashes map[string]uint64, distance int) [][]string {
+	if distance < 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(hashes))
+	for key := range hashes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	parents := make([]int, len(keys))
+	for i := range parents {
+		parents[i] = i
+	}
+	var find func(i int) int
+	find = func(i int) int {
+		if parents[i] != i {
+			parents[i] = find(parents[i])
+		}
+		return parents[i]
+	}
+	// from 64 bits on, hashes can differ in every bit, so a single block covering no bit compares every pair
+	masks := []uint64{0}
+	if distance < 64 {
+		masks = masks[:0]
+		blocks := distance + 1
+		for block := 0; block < blocks; block++ {
+			start, end := uint(block*64/blocks), uint((block+1)*64/blocks)
+			masks = append(masks, (^uint64(0)>>(64-(end-start)))<<start)
+		}
+	}
+	for _, mask := range masks {
+		buckets := map[uint64][]int{}
+		for i, key := range keys {
+			buckets[hashes[key]&mask] = append(buckets[hashes[key]&mask], i)
+		}
+		for _, bucket := range buckets {
+			for a := 0; a < len(bucket); a++ {
+				for b := a + 1; b < len(bucket); b++ {
+					i, j := bucket[a], bucket[b]
+					if find(i) != find(j) && Distance(hashes[keys[i]], hashes[keys[j]]) <= distance {
+						parents[find(j)] = find(i)
+					}
+				}
+			}
+		}
+	}
+	groups := map[int][]string{}
+	for i, key := range keys {
+		root := find(i)
+		groups[root] = append(groups[root], key)
+	}
+	var clusters [][]string
+	for _, group := range groups {
+		if len(group) > 1 {
+			clusters = append(clusters, group)
+		}
+	}
+	sort.Slice(clusters, func(i, j int) bool { return clusters[i][0] < clusters[j][0] })
+	return clusters
+}
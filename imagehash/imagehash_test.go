@@ -0,0 +1,97 @@
+package imagehash
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+// gradient draws a picture of size width x height, whose brightness follows a pattern that does not depend on its size.
+func gradient(width, height int, invert bool) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			value := uint8((x*255/width + y*128/height) % 256)
+			if (x*4/width)%2 == 1 {
+				value = 255 - value
+			}
+			if invert {
+				value = 255 - value
+			}
+			img.Set(x, y, color.RGBA{value, value / 2, 255 - value, 255})
+		}
+	}
+	return img
+}
+
+// hash encodes a picture as PNG, or JPEG when lossy is true, and returns its difference hash.
+func hash(t *testing.T, img image.Image, lossy bool) uint64 {
+	var buffer bytes.Buffer
+	if lossy {
+		jpeg.Encode(&buffer, img, &jpeg.Options{Quality: 60})
+	} else {
+		png.Encode(&buffer, img)
+	}
+	result, err := DHash(&buffer)
+	if err != nil {
+		t.Errorf("Unable to hash picture: %s", err.Error())
+		t.FailNow()
+	}
+	return result
+}
+
+func TestDHash(t *testing.T) {
+	original := hash(t, gradient(320, 240, false), false)
+	resized := hash(t, gradient(160, 120, false), true)
+	different := hash(t, gradient(320, 240, true), false)
+	if Distance(original, resized) > DefaultDistance {
+		t.Errorf("Expected a resized and re-encoded copy to be a near duplicate, got distance %d", Distance(original, resized))
+	}
+	if Distance(original, different) <= DefaultDistance {
+		t.Errorf("Expected a different picture not to be a near duplicate, got distance %d", Distance(original, different))
+	}
+	// pictures smaller than the grid are hashed too
+	hash(t, gradient(3, 2, false), false)
+	if _, err := DHash(bytes.NewReader([]byte("not a picture"))); err == nil {
+		t.Errorf("Expected files that are not pictures to be refused")
+	}
+	parsed, err := Parse(Format(0xf))
+	if err != nil || parsed != 0xf || Format(0xf) != "000000000000000f" {
+		t.Errorf("Expected hashes to be formatted as 16 hex digits")
+	}
+}
+
+func TestClusters(t *testing.T) {
+	hashes := map[string]uint64{
+		"a": 0x0,
+		"b": 0x7,            // 3 bits from a
+		"c": 0x7 | 0x70,     // 3 bits from b, 6 from a
+		"d": 0xff00ff00ff00, // far from everything
+		"e": 0xff00ff00ff01, // 1 bit from d
+		"f": 0xf0f0f0f0f0f0f0,
+	}
+	clusters := Clusters(hashes, 3)
+	if len(clusters) != 2 {
+		t.Errorf("Expected two clusters, got %v", clusters)
+		t.FailNow()
+	}
+	if len(clusters[0]) != 3 || clusters[0][0] != "a" || clusters[0][2] != "c" {
+		t.Errorf("Expected keys to be grouped through their neighbours, got %v", clusters[0])
+	}
+	if len(clusters[1]) != 2 || clusters[1][0] != "d" || clusters[1][1] != "e" {
+		t.Errorf("Unexpected second cluster %v", clusters[1])
+	}
+	if len(Clusters(hashes, 0)) != 0 {
+		t.Errorf("Expected no clusters among distinct hashes at distance 0")
+	}
+	if len(Clusters(hashes, 64)) != 1 {
+		t.Errorf("Expected every key in one cluster at distance 64")
+	}
+	opposite := map[string]uint64{"a": 0, "b": ^uint64(0)}
+	if len(Clusters(opposite, 63)) != 0 || len(Clusters(opposite, 64)) != 1 {
+		t.Errorf("Expected hashes differing in every bit to be grouped at distance 64 only")
+	}
+}
@@ -4,19 +4,28 @@ package main
 
 import (
 	"context"
+	"crypto/subtle"
+	"errors"
 	"flag"
-	"io/ioutil"
+	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
+	"github.com/auyer/colab-dataset/annotation"
+	"github.com/auyer/colab-dataset/builder"
 	"github.com/auyer/colab-dataset/config"
 	"github.com/auyer/colab-dataset/db"
-	"github.com/dgraph-io/badger"
+	"github.com/auyer/colab-dataset/export"
+	"github.com/auyer/colab-dataset/imagehash"
+	"github.com/auyer/colab-dataset/watch"
 	"github.com/labstack/echo"
 	"github.com/labstack/echo/middleware"
 	"github.com/labstack/gommon/color"
@@ -28,57 +37,298 @@ var confFlag = flag.String("config", "./config.json", "PATH to Configuration Fil
 
 var builddb = flag.Bool("builddb", false, "use this flag if DB shoud be built")
 
-// database stores the pointer for the voting databse
-var database *badger.DB
+var importManifest = flag.String("import", "", "PATH to a CSV or JSONL manifest listing the files of the static folder to insert in the DB, with their prior label counts and priority")
 
-// counterdb stores the pointer for the vote counter databse
-var counterdb *badger.DB
+var migrate = flag.String("migrate", "", "PATH to a Badger DB to copy into the bolt DB at the configured DatabasePath, then exit")
 
-// databasesize stores the amount of items found while scanning the folder
-var databasesize int
+var upgrade = flag.Bool("upgrade", false, "use this flag to convert a Badger DB written in the legacy score format, keeping its votes, then exit")
 
-// staticBuilder function reads through the provided directory and populates the databases
-func staticBuilder(dir string, dbpointer *badger.DB, counterdb *badger.DB) {
-	files, err := ioutil.ReadDir(dir)
-	if err != nil {
-		log.Fatal(err)
+var reconcile = flag.Bool("reconcile", false, "use this flag to update the DB with the files added, moved or removed from the static folder")
+
+// database stores the voting databse, holding every resource and vote record
+var database db.Store
+
+// databasesize stores the amount of items found while scanning the folder, updated atomically when the watcher finds new ones
+var databasesize int64
+
+// exports runs and tracks the export jobs started through the API
+var exports *export.Manager
+
+// exportTimeLayout formats the time an export started inside the names of export folders and archives.
+const exportTimeLayout = "2006-01-02T15-04-05"
+
+// buildOptions returns the options of the builder from the configuration, logging its progress under tag.
+func buildOptions(tag string) builder.Options {
+	ingest := config.ConfigParams.Ingest
+	return builder.Options{
+		Workers:  ingest.Workers,
+		Include:  ingest.Include,
+		Exclude:  ingest.Exclude,
+		Types:    ingest.Types,
+		Validate: ingest.Validate,
+		Progress: func(done int, total int) {
+			if done%1000 == 0 || done == total {
+				log.Println(color.Blue(tag) + " " + strconv.Itoa(done) + " of " + strconv.Itoa(total) + " files handled")
+			}
+		},
 	}
-	for _, f := range files {
+}
 
-		if f.IsDir() {
-			go staticBuilder(dir+"/"+f.Name(), dbpointer, counterdb)
-			log.Println(color.Blue("[BUILDDB]") + " Navigating into folder " + f.Name())
-		} else {
-			db.InsertResource(dir+"/"+f.Name(), 0, dbpointer)
-			db.InsertResource(dir+"/"+f.Name(), 0, counterdb)
-			log.Println(color.Blue("[BUILDDB]") + " Inserted " + f.Name())
+// logRejections logs the files a build or reconcile left out of the database, and the ones it failed to read.
+func logRejections(tag string, rejected []builder.Rejection, errs []string) {
+	for _, rejection := range rejected {
+		log.Println(color.Yellow(tag) + " Rejected " + rejection.Path + ": " + rejection.Reason)
+	}
+	for _, err := range errs {
+		log.Println(color.Red(tag) + " " + err)
+	}
+}
+
+// logReconcile logs the changes made by a reconcile under tag.
+func logReconcile(tag string, report builder.ReconcileReport) {
+	for from, to := range report.Moved {
+		log.Println(color.Blue(tag) + " " + from + " moved to " + to)
+	}
+	for _, key := range report.Missing {
+		log.Println(color.Yellow(tag) + " " + key + " is missing")
+	}
+	logRejections(tag, report.Rejected, report.Errors)
+	log.Println(color.Green(tag) + " " + report.String())
+}
+
+// nearDuplicates groups the pictures whose perceptual hashes are within distance bits of each other.
+func nearDuplicates(store db.Store, distance int) ([][]string, error) {
+	hashes := map[string]uint64{}
+	err := store.IterateResources(func(resource db.Resource, votes []db.VoteRecord) error {
+		if resource.PerceptualHash == "" {
+			return nil
+		}
+		hash, err := imagehash.Parse(resource.PerceptualHash)
+		if err == nil {
+			hashes[resource.Key] = hash
 		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
+	return imagehash.Clusters(hashes, distance), nil
 }
 
-func copy(src, dst string) {
-	input, err := ioutil.ReadFile(src)
+// duplicatesSummary logs every group of files holding the same content.
+func duplicatesSummary(store db.Store) {
+	groups, err := store.GetDuplicates()
 	if err != nil {
-		log.Println(err)
+		log.Println(color.Red("[BUILDDB]") + " Unable to list duplicates: " + err.Error())
 		return
 	}
-	dstsep := strings.Split(dst, "/")
-	dstsep = dstsep[:len(dstsep)-1]
-	fdst := ""
-	for _, i := range dstsep {
-		fdst = fdst + i + "/"
-	}
-	log.Println(fdst)
-	os.MkdirAll(fdst, os.ModePerm)
-	sepdst := strings.Split(src, "/")
-	sepdst = sepdst[:len(sepdst)-1]
-	err = ioutil.WriteFile(dst, input, os.ModePerm)
+	duplicates := 0
+	for _, group := range groups {
+		duplicates += len(group.Duplicates)
+		log.Println(color.Yellow("[DUPLICATES]") + " " + group.Canonical + " is also stored as " + strings.Join(group.Duplicates, ", "))
+	}
+	log.Println(color.Green(strconv.Itoa(duplicates)) + " duplicate files found in " + strconv.Itoa(len(groups)) + " groups")
+}
+
+// nearDuplicatesSummary logs every group of pictures that look alike.
+func nearDuplicatesSummary(store db.Store) {
+	clusters, err := nearDuplicates(store, imagehash.DefaultDistance)
 	if err != nil {
-		log.Println("Error creating", dst)
-		log.Println(err)
+		log.Println(color.Red("[BUILDDB]") + " Unable to list near duplicates: " + err.Error())
 		return
 	}
-	return
+	for _, cluster := range clusters {
+		log.Println(color.Yellow("[NEAR DUPLICATES]") + " " + strings.Join(cluster, ", "))
+	}
+	log.Println(color.Green(strconv.Itoa(len(clusters))) + " groups of near duplicate pictures found")
+}
+
+// labelScore returns the score change caused by a vote on label, and false if label is not in the configured schema.
+// The first configured label counts as a positive vote, every other label as a negative one,
+// so exports only rely on the score when exactly two labels are configured.
+func labelScore(label string) (int, bool) {
+	for index, l := range config.ConfigParams.Labels {
+		if l == label {
+			if index == 0 {
+				return 1, true
+			}
+			return -1, true
+		}
+	}
+	return 0, false
+}
+
+// exportSelection lists the files and manifests of an export into destination, from the threshold and query parameters of the request.
+// When the parameters are invalid, it also returns the HTTP status to answer with.
+func exportSelection(c echo.Context, destination string) ([]export.File, map[string]interface{}, int, error) {
+	cut, _ := strconv.ParseFloat(c.Param("thrs"), 32)
+	filter, err := export.ParseFilter(c.QueryParams())
+	if err != nil {
+		return nil, nil, http.StatusBadRequest, err
+	}
+	countedList, err := database.GetCurrentVotes()
+	if err != nil {
+		return nil, nil, http.StatusNotFound, err
+	}
+	countedList = filter.Filter(countedList)
+	// the class layouts export every picture, sorting them into class folders instead of discarding the ones below the threshold
+	var selected, flagged []db.Resource
+	var classify export.Classifier
+	switch c.QueryParam("layout") {
+	case "":
+		// with more than two labels the score only opposes the first label to the others, so the winning label is kept instead
+		if len(config.ConfigParams.Labels) > 2 {
+			selected, flagged = export.SelectWinners(countedList, cut)
+		} else {
+			selected, flagged = export.Select(countedList, cut)
+		}
+	case "binary":
+		if len(config.ConfigParams.Labels) > 2 {
+			return nil, nil, http.StatusBadRequest, errors.New("The binary layout needs exactly two Labels, use layout=class instead")
+		}
+		reject := -cut
+		if c.QueryParam("reject") != "" {
+			reject, err = strconv.ParseFloat(c.QueryParam("reject"), 64)
+			if err != nil {
+				return nil, nil, http.StatusBadRequest, err
+			}
+		}
+		selected, flagged = export.Unflagged(countedList)
+		classify = export.BinaryClassifier(cut, reject)
+	case "class":
+		selected, flagged = export.Unflagged(countedList)
+		classify = export.LabelClassifier(cut)
+	default:
+		return nil, nil, http.StatusBadRequest, errors.New("Unknown layout " + c.QueryParam("layout"))
+	}
+	manifests := map[string]interface{}{"labels.json": selected, "flagged.json": flagged}
+	splits := map[string][]db.Resource{"": selected}
+	if c.QueryParam("split") != "" {
+		ratios, err := export.ParseRatios(c.QueryParam("split"))
+		if err != nil {
+			return nil, nil, http.StatusBadRequest, err
+		}
+		seed, _ := strconv.ParseInt(c.QueryParam("seed"), 10, 64)
+		stratify, _ := strconv.ParseBool(c.QueryParam("stratify"))
+		splits = export.Split(selected, ratios, seed, stratify)
+		manifests["splits.json"] = export.SplitManifest(splits)
+	}
+	files := export.Files(destination, splits, classify)
+	if classify != nil {
+		manifests["classes.json"] = export.ClassManifest(files)
+	}
+	switch c.QueryParam("dataset") {
+	case "":
+	case "imagefolder":
+		metadata, err := export.ImageFolderMetadata(destination, files)
+		if err != nil {
+			return nil, nil, http.StatusInternalServerError, err
+		}
+		for name, content := range metadata {
+			manifests[name] = content
+		}
+	default:
+		return nil, nil, http.StatusBadRequest, errors.New("Unknown dataset format " + c.QueryParam("dataset"))
+	}
+	if c.QueryParam("annotations") != "" {
+		categories := config.ConfigParams.Labels
+		if c.QueryParam("layout") == "binary" {
+			categories = []string{export.Positive, export.Negative}
+		}
+		err = annotationManifests(strings.Split(c.QueryParam("annotations"), ","), destination, files, categories, manifests)
+		if err != nil {
+			return nil, nil, http.StatusBadRequest, err
+		}
+	}
+	return files, manifests, http.StatusOK, nil
+}
+
+// annotationManifests adds the COCO and VOC annotations of the exported files to manifests, for each of the requested formats.
+// Pictures are annotated with their class folder, or their winning label when the export has no class layout.
+func annotationManifests(formats []string, destination string, files []export.File, categories []string, manifests map[string]interface{}) error {
+	var images []annotation.Image
+	for _, file := range files {
+		label := file.Resource.Winner
+		if file.Class != "" {
+			label = file.Class
+		}
+		if label == export.Undecided {
+			label = ""
+		}
+		fileName, err := filepath.Rel(destination, file.Destination)
+		if err != nil {
+			return err
+		}
+		image, err := annotation.NewImage(file.Source, filepath.ToSlash(fileName), label)
+		if err != nil {
+			log.Println(color.Yellow("[ANNOTATIONS]") + " Unable to read " + file.Source + ": " + err.Error())
+			continue
+		}
+		images = append(images, image)
+	}
+	for _, format := range formats {
+		switch format {
+		case "coco":
+			content, err := annotation.NewCOCO(images, categories, time.Now()).Encode()
+			if err != nil {
+				return err
+			}
+			manifests["annotations.json"] = content
+		case "voc":
+			names := annotation.VOCNames(images)
+			for i, image := range images {
+				content, err := annotation.NewVOC(image).Encode()
+				if err != nil {
+					return err
+				}
+				manifests[names[i]] = content
+			}
+		default:
+			return errors.New("Unknown annotation format " + format)
+		}
+	}
+	return nil
+}
+
+// results answers /api/results/ with the records of the pictures matching the metadata filters of the query,
+// or with a label file when format is csv or jsonl.
+func results(c echo.Context) error {
+	filter, err := export.ParseFilter(c.QueryParams())
+	if err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+	if format := c.QueryParam("format"); format != "" {
+		contentType := map[string]string{export.FormatCSV: "text/csv", export.FormatJSONL: "application/x-ndjson"}[format]
+		if contentType == "" {
+			return c.String(http.StatusBadRequest, export.ErrUnknownFormat.Error()+" "+format)
+		}
+		c.Response().Header().Set(echo.HeaderContentType, contentType)
+		c.Response().Header().Set(echo.HeaderContentDisposition, "attachment; filename=\"labels."+format+"\"")
+		c.Response().WriteHeader(http.StatusOK)
+		encoder, err := export.NewLabelEncoder(c.Response(), format, config.ConfigParams.Labels)
+		if err == nil {
+			err = database.IterateResources(func(resource db.Resource, votes []db.VoteRecord) error {
+				if !filter.Match(resource) {
+					return nil
+				}
+				return encoder.Encode(export.NewLabelRow(resource, votes))
+			})
+		}
+		if err == nil {
+			err = encoder.Flush()
+		}
+		if err != nil {
+			// the headers were already sent, so the client only sees a truncated file
+			c.Logger().Info(err.Error())
+		}
+		return nil
+	}
+	countedList, err := database.GetCurrentVotes()
+	if err != nil {
+		c.Logger().Info(err.Error())
+		return c.String(http.StatusNotFound, err.Error())
+	}
+	return c.JSON(http.StatusAccepted, filter.Filter(countedList)) //c.Request().Host+
 }
 
 func main() {
@@ -99,28 +349,109 @@ func main() {
 
 	// Database Loading
 
-	database, err = db.Init(config.ConfigParams.DatabasePath)
+	if *upgrade {
+		log.Println(color.Red("[WORKING]") + "Converting the legacy DB at " + config.ConfigParams.DatabasePath)
+		resources, err := db.UpgradeLegacy(config.ConfigParams.DatabasePath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Println(color.Green("[DONE]") + " " + strconv.Itoa(resources) + " entries converted")
+		return
+	}
+	if *migrate != "" {
+		if config.ConfigParams.Storage != db.EngineBolt {
+			log.Fatal("-migrate copies a Badger DB into a bolt DB, so Storage must be set to " + db.EngineBolt)
+		}
+		log.Println(color.Red("[WORKING]") + "Migrating " + *migrate + " into " + config.ConfigParams.DatabasePath)
+		resources, err := db.MigrateBadger(*migrate, config.ConfigParams.DatabasePath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Println(color.Green("[DONE]") + " " + strconv.Itoa(resources) + " entries migrated")
+		return
+	}
+	database, err = db.OpenEngine(config.ConfigParams.Storage, config.ConfigParams.DatabasePath)
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer database.Close()
-	counterdb, err = db.Init(config.ConfigParams.DatabasePath + ".count")
-	if err != nil {
-		log.Fatal(err)
+	db.LeaseTTL = time.Duration(config.ConfigParams.LeaseTTL) * time.Second
+	db.CompletionPolicy = db.Policy{
+		MinVotes:  config.ConfigParams.Completion.MinVotes,
+		Agreement: config.ConfigParams.Completion.Agreement,
+		MaxVotes:  config.ConfigParams.Completion.MaxVotes,
+		MaxSkips:  config.ConfigParams.Completion.MaxSkips,
 	}
-	defer counterdb.Close()
 	if *builddb {
 		log.Println(color.Red("[WORKING]") + "Building database")
-		staticBuilder("."+config.ConfigParams.StaticFolder, database, counterdb)
-		log.Println(color.Green("[DONE]") + "Database Built.")
+		report, err := builder.Build("."+config.ConfigParams.StaticFolder, database, buildOptions("[BUILDDB]"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		logRejections("[BUILDDB]", report.Rejected, report.Errors)
+		log.Printf("%s Database Built. %d files found, %d inserted, %d already in the database, %d duplicates, %d rejected, %d errors",
+			color.Green("[DONE]"), report.Files, report.Inserted, report.Existing, report.Duplicates, len(report.Rejected), len(report.Errors))
+		duplicatesSummary(database)
+		nearDuplicatesSummary(database)
+	}
+	if *importManifest != "" {
+		log.Println(color.Red("[WORKING]") + "Importing " + *importManifest)
+		rows, err := builder.ReadManifest(*importManifest)
+		if err != nil {
+			log.Fatal(err)
+		}
+		report, err := builder.Import("."+config.ConfigParams.StaticFolder, rows, config.ConfigParams.Labels, database, buildOptions("[IMPORT]"))
+		logRejections("[IMPORT]", report.Rejected, report.Errors)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("%s Manifest imported. %d files listed, %d inserted, %d already in the database, %d duplicates, %d rejected, %d errors",
+			color.Green("[DONE]"), report.Files, report.Inserted, report.Existing, report.Duplicates, len(report.Rejected), len(report.Errors))
+		duplicatesSummary(database)
+	}
+	if *reconcile {
+		log.Println(color.Red("[WORKING]") + "Reconciling database")
+		report, err := builder.Reconcile("."+config.ConfigParams.StaticFolder, database, buildOptions("[RECONCILE]"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		logReconcile("[RECONCILE]", report)
+	}
+	databasesize = int64(database.CountDBSize())
+	log.Println(color.Green(strconv.FormatInt(databasesize, 10)) + " entries in the Database")
+	if config.ConfigParams.Watch {
+		dir := "." + config.ConfigParams.StaticFolder
+		debounce := time.Duration(config.ConfigParams.WatchDebounce) * time.Millisecond
+		watcher, err := watch.New(dir, debounce, func(changed []string) {
+			log.Println(color.Blue("[WATCH]") + " " + strconv.Itoa(len(changed)) + " changes in the static folder")
+			report, err := builder.Reconcile(dir, database, buildOptions("[WATCH]"))
+			if err != nil {
+				log.Println(color.Red("[WATCH]") + " " + err.Error())
+				return
+			}
+			logReconcile("[WATCH]", report)
+			atomic.StoreInt64(&databasesize, int64(database.CountDBSize()))
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer watcher.Close()
+		log.Println(color.Green("[WATCH]") + " Watching " + dir + " for new files")
+	}
+
+	exports = export.NewManager(config.ConfigParams.ExportWorkers)
+	if !export.ValidMode(config.ConfigParams.ExportMode) {
+		log.Fatal(export.ErrUnknownMode.Error() + " " + config.ConfigParams.ExportMode)
 	}
-	databasesize = db.CountDBSize(database)
-	log.Println(color.Green(strconv.Itoa(databasesize)) + " entries in the Database")
 
 	server.Use(middleware.Logger())
 	server.Use(middleware.Recover())
 	server.Use(middleware.GzipWithConfig(middleware.GzipConfig{
 		Level: 5,
+		// archives are already compressed
+		Skipper: func(c echo.Context) bool {
+			return strings.HasPrefix(c.Request().URL.Path, "/api/archive/")
+		},
 	}))
 
 	// server.Use(middleware.Static(config.ConfigParams.LogLocation))
@@ -130,6 +461,9 @@ func main() {
 		HTML5:  true,
 	}))
 
+	server.GET("/api/labels/", func(c echo.Context) error {
+		return c.JSON(http.StatusOK, config.ConfigParams.Labels)
+	})
 	server.POST("/api/vote/", func(c echo.Context) error {
 		var vote db.Vote
 		err := c.Bind(&vote)
@@ -137,18 +471,23 @@ func main() {
 			server.Logger.Info(err)
 			return c.String(http.StatusBadRequest, err.Error())
 		}
-		if vote.Vote == "true" {
-			// log.Print("POSITIVE VOTE")
-			db.UpdateResource(vote.Key, 1, counterdb)
-			db.UpdateResource(vote.Key, 1, database)
-			return c.String(200, " ")
-		} else if vote.Vote == "false" {
-			// log.Print("NEGATIVE VOTE")
-			db.UpdateResource(vote.Key, 1, counterdb)
-			db.UpdateResource(vote.Key, -1, database)
-			return c.String(200, " ")
-		}
-		return c.String(500, " ")
+		if vote.Annotator == "" {
+			return c.String(http.StatusBadRequest, "Missing Annotator")
+		}
+		score, ok := labelScore(vote.Vote)
+		if !ok {
+			return c.String(http.StatusBadRequest, "Unknown label "+vote.Vote)
+		}
+		err = database.CastVote(db.VoteRecord{Annotator: vote.Annotator, Key: vote.Key, Label: vote.Vote, Score: score, Timestamp: time.Now()})
+		if err == db.ErrDuplicateVote {
+			return c.String(http.StatusConflict, err.Error())
+		} else if err == db.ErrNotFound {
+			return c.String(http.StatusNotFound, err.Error())
+		} else if err != nil {
+			server.Logger.Info(err.Error())
+			return c.String(http.StatusInternalServerError, err.Error())
+		}
+		return c.String(200, " ")
 	})
 	server.POST("/api/unvote/", func(c echo.Context) error {
 		var vote db.Vote
@@ -157,23 +496,46 @@ func main() {
 			server.Logger.Info(err)
 			return c.String(http.StatusBadRequest, err.Error())
 		}
-		if vote.Vote == "true" {
-			// log.Print("Undoing POSITIVE VOTE")
-			db.UpdateResource(vote.Key, -1, counterdb)
-			db.UpdateResource(vote.Key, -1, database)
-			return c.String(200, " ")
-		} else if vote.Vote == "false" {
-			// log.Print("Undoing NEGATIVE VOTE")
-			db.UpdateResource(vote.Key, -1, counterdb)
-			db.UpdateResource(vote.Key, 1, database)
-			return c.String(200, " ")
-		}
-		return c.String(500, " ")
+		if vote.Annotator == "" {
+			return c.String(http.StatusBadRequest, "Missing Annotator")
+		}
+		// The vote being undone is the one stored in the record, not the one sent by the client.
+		_, err = database.RetractVote(vote.Key, vote.Annotator)
+		if err == db.ErrVoteNotFound {
+			return c.String(http.StatusNotFound, err.Error())
+		} else if err != nil {
+			server.Logger.Info(err.Error())
+			return c.String(http.StatusInternalServerError, err.Error())
+		}
+		return c.String(200, " ")
+	})
+	server.POST("/api/skip/", func(c echo.Context) error {
+		var skip db.Skip
+		err := c.Bind(&skip)
+		if err != nil {
+			server.Logger.Info(err)
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		if skip.Annotator == "" {
+			return c.String(http.StatusBadRequest, "Missing Annotator")
+		}
+		err = database.SkipResource(db.SkipRecord{Annotator: skip.Annotator, Key: skip.Key, Reason: skip.Reason, Timestamp: time.Now()})
+		if err == db.ErrUnknownReason {
+			return c.String(http.StatusBadRequest, err.Error())
+		} else if err == db.ErrDuplicateSkip {
+			return c.String(http.StatusConflict, err.Error())
+		} else if err == db.ErrNotFound {
+			return c.String(http.StatusNotFound, err.Error())
+		} else if err != nil {
+			server.Logger.Info(err.Error())
+			return c.String(http.StatusInternalServerError, err.Error())
+		}
+		return c.String(200, " ")
 	})
 	server.POST("/api/getnewkey/", func(c echo.Context) error {
 		var vote db.Vote
 		err := c.Bind(&vote)
-		value, err := db.GetNewSortedKey(counterdb, vote.Key)
+		value, err := database.GetNewSortedKey(vote.Key, vote.Annotator)
 		if err != nil {
 			server.Logger.Info(err.Error())
 			return c.String(http.StatusNotFound, err.Error())
@@ -181,7 +543,7 @@ func main() {
 		return c.String(http.StatusAccepted, value) //c.Request().Host+
 	})
 	server.GET("/api/getkey/", func(c echo.Context) error {
-		value, err := db.GetSortedKey(counterdb)
+		value, err := database.GetSortedKey(c.QueryParam("annotator"))
 		if err != nil {
 			server.Logger.Info(err.Error())
 			return c.String(http.StatusNotFound, err.Error())
@@ -190,56 +552,176 @@ func main() {
 	})
 	server.GET("/api/getTotalSize/", func(c echo.Context) error {
 		// log.Println(databasesize)
-		return c.String(http.StatusAccepted, strconv.Itoa(databasesize)) //c.Request().Host+
+		return c.String(http.StatusAccepted, strconv.FormatInt(atomic.LoadInt64(&databasesize), 10)) //c.Request().Host+
 	})
 
-	server.GET("/api/results/", func(c echo.Context) error {
-		var countedList []db.VoteIntAmt
-		value, err := db.GetCurrentVotes(database)
+	server.GET("/api/results/", results)
+	// keys are paths such as ./static/a/b.jpg, so they are matched with a wildcard, with or without their leading ./
+	server.GET("/api/items/*", func(c echo.Context) error {
+		key, err := url.PathUnescape(c.Param("*"))
 		if err != nil {
-			server.Logger.Info(err.Error())
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		resource, err := database.GetResource(key)
+		if err == db.ErrNotFound && !strings.HasPrefix(key, "./") {
+			resource, err = database.GetResource("./" + key)
+		}
+		if err == db.ErrNotFound {
 			return c.String(http.StatusNotFound, err.Error())
+		} else if err != nil {
+			server.Logger.Info(err.Error())
+			return c.String(http.StatusInternalServerError, err.Error())
 		}
-		counter, err := db.GetCurrentVotes(counterdb)
+		return c.JSON(http.StatusOK, resource)
+	})
+
+	server.GET("/api/duplicates/", func(c echo.Context) error {
+		groups, err := database.GetDuplicates()
 		if err != nil {
 			server.Logger.Info(err.Error())
-			return c.String(http.StatusNotFound, err.Error())
+			return c.String(http.StatusInternalServerError, err.Error())
 		}
-		for index, item := range value {
-			if item.Key == counter[index].Key {
-				countedList = append(countedList, db.VoteIntAmt{item.Key, item.Vote, counter[index].Vote})
-			} else {
-				log.Fatal("Unmatching Database")
+		return c.JSON(http.StatusOK, groups)
+	})
+
+	server.GET("/api/near-duplicates/", func(c echo.Context) error {
+		distance := imagehash.DefaultDistance
+		if c.QueryParam("distance") != "" {
+			parsed, err := strconv.Atoi(c.QueryParam("distance"))
+			if err != nil || parsed < 0 || parsed > 64 {
+				return c.String(http.StatusBadRequest, "distance must be between 0 and 64")
 			}
+			distance = parsed
 		}
-		return c.JSON(http.StatusAccepted, countedList) //c.Request().Host+
+		clusters, err := nearDuplicates(database, distance)
+		if err != nil {
+			server.Logger.Info(err.Error())
+			return c.String(http.StatusInternalServerError, err.Error())
+		}
+		return c.JSON(http.StatusOK, clusters)
 	})
 
+	// uploads are only served when a token is configured, and every request must carry it as "Authorization: Bearer <token>"
+	if config.ConfigParams.Upload.Token != "" {
+		server.POST("/api/upload/", func(c echo.Context) error {
+			dir := "." + config.ConfigParams.StaticFolder
+			reader, err := c.Request().MultipartReader()
+			if err != nil {
+				return c.String(http.StatusBadRequest, err.Error())
+			}
+			report := builder.Report{Rejected: []builder.Rejection{}, Errors: []string{}}
+			for {
+				part, err := reader.NextPart()
+				if err == io.EOF {
+					break
+				} else if err == echo.ErrStatusRequestEntityTooLarge {
+					return err
+				} else if err != nil {
+					return c.String(http.StatusBadRequest, err.Error())
+				}
+				if part.FileName() == "" {
+					part.Close()
+					continue
+				}
+				report.Files++
+				target, err := builder.UploadPath(dir, c.QueryParam("folder"), part.FileName())
+				if err == nil {
+					err = builder.Upload(dir, target, part, config.ConfigParams.Upload.MaxSize, database, buildOptions("[UPLOAD]"), &report)
+				}
+				part.Close()
+				switch err {
+				case echo.ErrStatusRequestEntityTooLarge:
+					return err
+				case nil:
+				case builder.ErrInvalidPath, builder.ErrFileExists, builder.ErrTooLarge:
+					report.Rejected = append(report.Rejected, builder.Rejection{Path: part.FileName(), Reason: err.Error()})
+				default:
+					server.Logger.Info(err.Error())
+					report.Errors = append(report.Errors, part.FileName()+": "+err.Error())
+				}
+			}
+			if report.Files == 0 {
+				return c.String(http.StatusBadRequest, "No file uploaded")
+			}
+			atomic.AddInt64(&databasesize, int64(report.Inserted))
+			if report.Inserted+report.Existing+report.Duplicates == 0 {
+				return c.JSON(http.StatusUnprocessableEntity, report)
+			}
+			return c.JSON(http.StatusCreated, report)
+		}, middleware.KeyAuth(func(key string, c echo.Context) (bool, error) {
+			return subtle.ConstantTimeCompare([]byte(key), []byte(config.ConfigParams.Upload.Token)) == 1, nil
+		}), middleware.BodyLimit(strconv.FormatInt(config.ConfigParams.Upload.MaxRequestSize, 10)))
+	}
+
 	server.PATCH("/api/export/:thrs", func(c echo.Context) error {
-		thrs := c.Param("thrs")
-		cut, _ := strconv.ParseFloat(thrs, 32)
-		t := time.Now()
-		timestamp := strconv.Itoa(t.Year()) + "-" + t.Month().String() + "-" + strconv.Itoa(t.Day()) + "-" + strconv.Itoa(t.Hour()) + "-" + strconv.Itoa(t.Second())
-		value, err := db.GetCurrentVotes(database)
+		id, err := export.NewID()
 		if err != nil {
 			server.Logger.Info(err.Error())
-			return c.String(http.StatusNotFound, err.Error())
+			return c.String(http.StatusInternalServerError, err.Error())
 		}
-		counter, err := db.GetCurrentVotes(counterdb)
+		// the job ID keeps exports started within the same second apart
+		destination := "./" + "export_" + time.Now().Format(exportTimeLayout) + "_" + id
+		files, manifests, status, err := exportSelection(c, destination)
 		if err != nil {
+			return c.String(status, err.Error())
+		}
+		mode := c.QueryParam("mode")
+		if mode == "" {
+			mode = config.ConfigParams.ExportMode
+		}
+		job, err := exports.Start(id, destination, mode, files, manifests)
+		if err == export.ErrUnknownMode {
+			return c.String(http.StatusBadRequest, err.Error()+" "+mode)
+		} else if err == export.ErrDestinationExists {
+			return c.String(http.StatusConflict, err.Error()+" "+destination)
+		} else if err != nil {
 			server.Logger.Info(err.Error())
+			return c.String(http.StatusInternalServerError, err.Error())
+		}
+		return c.JSON(http.StatusAccepted, job)
+	})
+	server.GET("/api/archive/:thrs", func(c echo.Context) error {
+		format := c.QueryParam("format")
+		if format == "" {
+			format = export.FormatZip
+		}
+		contentType := map[string]string{export.FormatZip: "application/zip", export.FormatTarGz: "application/gzip"}[format]
+		if contentType == "" {
+			return c.String(http.StatusBadRequest, export.ErrUnknownFormat.Error()+" "+format)
+		}
+		files, manifests, status, err := exportSelection(c, "")
+		if err != nil {
+			return c.String(status, err.Error())
+		}
+		name := "export_" + time.Now().Format(exportTimeLayout) + "." + format
+		c.Response().Header().Set(echo.HeaderContentType, contentType)
+		c.Response().Header().Set(echo.HeaderContentDisposition, "attachment; filename=\""+name+"\"")
+		c.Response().WriteHeader(http.StatusOK)
+		err = export.WriteArchive(c.Request().Context(), c.Response(), format, files, manifests)
+		if err != nil {
+			// the headers were already sent, so the client only sees a truncated archive
+			server.Logger.Info(err.Error())
+		}
+		return nil
+	})
+	server.GET("/api/export/jobs/", func(c echo.Context) error {
+		return c.JSON(http.StatusOK, exports.List())
+	})
+	server.GET("/api/export/jobs/:id", func(c echo.Context) error {
+		job, err := exports.Get(c.Param("id"))
+		if err != nil {
 			return c.String(http.StatusNotFound, err.Error())
 		}
-		for index, item := range value {
-			if item.Key == counter[index].Key {
-				if float64(item.Vote) >= float64(counter[index].Vote)*cut {
-					go copy(item.Key, "./"+"export_"+timestamp+"/"+item.Key)
-				}
-			} else {
-				log.Fatal("Unmatching Database")
-			}
+		return c.JSON(http.StatusOK, job)
+	})
+	server.DELETE("/api/export/jobs/:id", func(c echo.Context) error {
+		err := exports.Cancel(c.Param("id"))
+		if err == export.ErrJobFinished {
+			return c.String(http.StatusConflict, err.Error())
+		} else if err != nil {
+			return c.String(http.StatusNotFound, err.Error())
 		}
-		return c.String(http.StatusAccepted, "Exporting. Check server.")
+		return c.String(http.StatusAccepted, "Cancelling export.")
 	})
 	if config.AutoTLS {
 		server.AutoTLSManager.Cache = autocert.DirCache("./cert/")
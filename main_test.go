@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/auyer/colab-dataset/db"
+	"github.com/labstack/echo"
+)
+
+func TestResultsFormat(t *testing.T) {
+	database = db.NewMemoryStore()
+	defer database.Close()
+	for _, key := range []string{"./static/wide.jpg", "./static/square.png"} {
+		database.InsertResource(key)
+	}
+	database.SetMetadata("./static/wide.jpg", db.Metadata{Width: 400, Height: 200, Format: "jpeg"})
+	database.SetMetadata("./static/square.png", db.Metadata{Width: 100, Height: 100, Format: "png"})
+	server := echo.New()
+	cases := []struct {
+		query string
+		lines int
+		keys  []string
+	}{
+		{"format=csv", 3, []string{"wide.jpg", "square.png"}},
+		{"format=jsonl", 2, []string{"wide.jpg", "square.png"}},
+		{"format=csv&image_format=png", 2, []string{"square.png"}},
+	}
+	for _, c := range cases {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodGet, "/api/results/?"+c.query, nil)
+		err := results(server.NewContext(request, recorder))
+		if err != nil || recorder.Code != http.StatusOK {
+			t.Errorf("Unable to get /api/results/?%s: %d %v", c.query, recorder.Code, err)
+			continue
+		}
+		body := recorder.Body.String()
+		if lines := strings.Count(strings.TrimSpace(body), "\n") + 1; lines != c.lines {
+			t.Errorf("Expected %d lines for /api/results/?%s, got %q", c.lines, c.query, body)
+		}
+		for _, key := range c.keys {
+			if !strings.Contains(body, key) {
+				t.Errorf("Expected %s in /api/results/?%s, got %q", key, c.query, body)
+			}
+		}
+	}
+}
@@ -0,0 +1,123 @@
+// Package watch reports the files created, written, removed or renamed inside a folder and its subfolders,
+// batching bursts of changes such as bulk copies into a single report.
+package watch
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Watcher watches a folder tree, calling its handler with the paths that changed once no change happened for the debounce duration.
+type Watcher struct {
+	watcher  *fsnotify.Watcher
+	debounce time.Duration
+	handle   func(changed []string)
+	done     chan struct{}
+}
+
+// New starts watching dir and every folder inside it, including the ones created later.
+// handle is called from a single goroutine, so batches never overlap.
+func New(dir string, debounce time.Duration, handle func(changed []string)) (*Watcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	w := &Watcher{watcher: watcher, debounce: debounce, handle: handle, done: make(chan struct{})}
+	_, err = w.addTree(dir)
+	if err != nil {
+		watcher.Close()
+		return nil, err
+	}
+	go w.run()
+	return w, nil
+}
+
+// Close stops watching, waiting for the batch being handled to finish. Pending changes are dropped.
+func (w *Watcher) Close() error {
+	err := w.watcher.Close()
+	<-w.done
+	return err
+}
+
+// addTree watches dir and every folder inside it, returning the files found inside them.
+// Files copied into a new folder before it is watched produce no events, so they are reported this way.
+func (w *Watcher) addTree(dir string) (files []string, err error) {
+	err = w.watcher.Add(dir)
+	if err != nil {
+		return nil, err
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, info := range infos {
+		path := filepath.Join(dir, info.Name())
+		if info.IsDir() {
+			inner, err := w.addTree(path)
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, inner...)
+		} else {
+			files = append(files, path)
+		}
+	}
+	return files, nil
+}
+
+// run collects events until the watcher is closed, handling them in batches.
+func (w *Watcher) run() {
+	defer close(w.done)
+	pending := map[string]bool{}
+	timer := time.NewTimer(w.debounce)
+	timer.Stop()
+	for {
+		select {
+		case event, ok := <-w.watcher.Events:
+			if !ok {
+				timer.Stop()
+				return
+			}
+			pending[event.Name] = true
+			if event.Op&fsnotify.Create != 0 {
+				if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+					files, err := w.addTree(event.Name)
+					if err != nil {
+						log.Println("Unable to watch " + event.Name + ": " + err.Error())
+					}
+					for _, file := range files {
+						pending[file] = true
+					}
+				}
+			}
+			// a timer that fired while this event was read still holds its tick, which is dropped before restarting it
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(w.debounce)
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				timer.Stop()
+				return
+			}
+			log.Println("Unable to watch files: " + err.Error())
+		case <-timer.C:
+			changed := make([]string, 0, len(pending))
+			for path := range pending {
+				changed = append(changed, path)
+			}
+			sort.Strings(changed)
+			pending = map[string]bool{}
+			w.handle(changed)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package watch
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+const testDir = "./watch_test.go.tmp"
+
+// nextBatch waits for the next batch of changes.
+func nextBatch(t *testing.T, batches chan []string) []string {
+	select {
+	case batch := <-batches:
+		return batch
+	case <-time.After(5 * time.Second):
+		t.Errorf("Expected a batch of changes")
+		t.FailNow()
+	}
+	return nil
+}
+
+// contains reports whether changed lists path.
+func contains(changed []string, path string) bool {
+	for _, item := range changed {
+		if item == path {
+			return true
+		}
+	}
+	return false
+}
+
+func TestWatcher(t *testing.T) {
+	os.RemoveAll(testDir)
+	os.MkdirAll(filepath.Join(testDir, "old"), os.ModePerm)
+	defer os.RemoveAll(testDir)
+	batches := make(chan []string, 10)
+	watcher, err := New(testDir, 100*time.Millisecond, func(changed []string) {
+		batches <- changed
+	})
+	if err != nil {
+		t.Errorf("Unable to start watcher: %s", err.Error())
+		t.FailNow()
+	}
+	defer watcher.Close()
+	for i := 0; i < 20; i++ {
+		ioutil.WriteFile(filepath.Join(testDir, "old", strconv.Itoa(i)+".jpg"), []byte("picture"), os.ModePerm)
+	}
+	batch := nextBatch(t, batches)
+	if !contains(batch, filepath.Join(testDir, "old", "0.jpg")) || !contains(batch, filepath.Join(testDir, "old", "19.jpg")) {
+		t.Errorf("Expected a bulk copy to be reported in a single batch, got %v", batch)
+	}
+	// files written into a new folder before it is watched are reported too
+	os.MkdirAll(filepath.Join(testDir, "new", "inner"), os.ModePerm)
+	ioutil.WriteFile(filepath.Join(testDir, "new", "inner", "a.jpg"), []byte("picture"), os.ModePerm)
+	batch = nextBatch(t, batches)
+	if !contains(batch, filepath.Join(testDir, "new", "inner", "a.jpg")) {
+		t.Errorf("Expected files inside new folders to be reported, got %v", batch)
+	}
+	os.Remove(filepath.Join(testDir, "old", "3.jpg"))
+	batch = nextBatch(t, batches)
+	if len(batch) != 1 || batch[0] != filepath.Join(testDir, "old", "3.jpg") {
+		t.Errorf("Expected the removed file to be reported, got %v", batch)
+	}
+}